@@ -0,0 +1,84 @@
+package dockerguard
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/micoud/dockerguard/config"
+)
+
+// splitAPIVersion ... API version and the rest of a path like /v1.41/containers/json,
+// the version is "" for paths without one
+func splitAPIVersion(path string) (string, string) {
+	m := versionRegex.FindStringSubmatch(path)
+	if m == nil {
+		return "", path
+	}
+	return m[1], path[len("/v")+len(m[1]):]
+}
+
+// setAPIVersion ... rewrites the path of req to version, path is the part after the version
+func setAPIVersion(req *http.Request, version string, path string) {
+	req.URL.Path = "/v" + version + path
+}
+
+// checkAPIVersion ... error if version is out of the range of c. Requests without
+// a version get the latest version of the daemon, so they are only allowed if there
+// is no maximum or the version is pinned.
+func checkAPIVersion(version string, c *config.APIVersion) error {
+	if c == nil {
+		return nil
+	}
+	if version == "" {
+		if c.Max != "" && c.Pin == "" {
+			return fmt.Errorf("API version required, maximum is %s", c.Max)
+		}
+		return nil
+	}
+	if c.Min != "" && config.CompareAPIVersions(version, c.Min) < 0 {
+		return fmt.Errorf("API version %s is too old, minimum is %s", version, c.Min)
+	}
+	if c.Max != "" && config.CompareAPIVersions(version, c.Max) > 0 {
+		return fmt.Errorf("API version %s is too new, maximum is %s", version, c.Max)
+	}
+	return nil
+}
+
+// capAPIVersion ... lowers the API version the daemon announces in responses to /_ping
+// to the pinned or maximum version, so clients negotiate a version that is allowed
+func capAPIVersion(upstream http.Handler, c *config.APIVersion) http.Handler {
+	if c == nil || (c.Pin == "" && c.Max == "") {
+		return upstream
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstream.ServeHTTP(&versionHeaderWriter{ResponseWriter: w, c: c}, req)
+	})
+}
+
+// versionHeaderWriter ... rewrites the Api-Version header before it is written
+type versionHeaderWriter struct {
+	http.ResponseWriter
+	c           *config.APIVersion
+	wroteHeader bool
+}
+
+func (vw *versionHeaderWriter) WriteHeader(code int) {
+	if !vw.wroteHeader {
+		vw.wroteHeader = true
+		h := vw.Header()
+		switch version := h.Get("Api-Version"); {
+		case vw.c.Pin != "":
+			h.Set("Api-Version", vw.c.Pin)
+		case version == "" || config.CompareAPIVersions(version, vw.c.Max) > 0:
+			h.Set("Api-Version", vw.c.Max)
+		}
+	}
+	vw.ResponseWriter.WriteHeader(code)
+}
+
+func (vw *versionHeaderWriter) Write(b []byte) (int, error) {
+	if !vw.wroteHeader {
+		vw.WriteHeader(http.StatusOK)
+	}
+	return vw.ResponseWriter.Write(b)
+}
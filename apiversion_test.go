@@ -0,0 +1,93 @@
+package dockerguard
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/micoud/dockerguard/config"
+)
+
+func TestAPIVersion(t *testing.T) {
+	routes := []config.Route{
+		{Method: "GET", Pattern: "^/containers/json$"},
+		{Method: "POST", Pattern: "^/containers/create$", APIVersion: &config.APIVersion{Min: "1.40"}},
+		{Method: "POST", Pattern: "^/build$", APIVersion: &config.APIVersion{Pin: "1.39"}},
+	}
+
+	tests := []struct {
+		global    *config.APIVersion
+		method    string
+		target    string
+		expected  int
+		forwarded string
+	}{
+		{nil, "GET", "/v1.12/containers/json", http.StatusOK, "/v1.12/containers/json"},
+		{nil, "GET", "/containers/json", http.StatusOK, "/containers/json"},
+		{nil, "GET", "/v1.41x/containers/json", http.StatusForbidden, ""},
+		{nil, "GET", "/v1.41.0/containers/json", http.StatusForbidden, ""},
+		{nil, "POST", "/v1.39/containers/create", http.StatusForbidden, ""},
+		{nil, "POST", "/v1.41/containers/create", http.StatusOK, "/v1.41/containers/create"},
+		{nil, "POST", "/containers/create", http.StatusOK, "/containers/create"},
+		{nil, "POST", "/v1.41/build", http.StatusOK, "/v1.39/build"},
+		{nil, "POST", "/build", http.StatusOK, "/v1.39/build"},
+		{&config.APIVersion{Min: "1.30", Max: "1.41"}, "GET", "/v1.29/containers/json", http.StatusForbidden, ""},
+		{&config.APIVersion{Min: "1.30", Max: "1.41"}, "GET", "/v1.9/containers/json", http.StatusForbidden, ""},
+		{&config.APIVersion{Min: "1.30", Max: "1.41"}, "GET", "/v1.42/containers/json", http.StatusForbidden, ""},
+		{&config.APIVersion{Min: "1.30", Max: "1.41"}, "GET", "/v1.41/containers/json", http.StatusOK, "/v1.41/containers/json"},
+		{&config.APIVersion{Min: "1.30", Max: "1.41"}, "GET", "/containers/json", http.StatusForbidden, ""},
+		{&config.APIVersion{Min: "1.30", Max: "1.41"}, "GET", "/_ping", http.StatusOK, "/_ping"},
+		{&config.APIVersion{Min: "1.30", Max: "1.41"}, "GET", "/v1.42/_ping", http.StatusForbidden, ""},
+		{&config.APIVersion{Pin: "1.41"}, "GET", "/containers/json", http.StatusOK, "/v1.41/containers/json"},
+		{&config.APIVersion{Pin: "1.41"}, "GET", "/v1.24/containers/json", http.StatusOK, "/v1.41/containers/json"},
+		{&config.APIVersion{Pin: "1.41"}, "POST", "/v1.24/build", http.StatusOK, "/v1.39/build"},
+	}
+
+	for _, test := range tests {
+		r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{Routes: routes, APIVersion: test.global}}
+		var forwarded string
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			forwarded = req.URL.Path
+		})
+
+		req := httptest.NewRequest(test.method, test.target, nil)
+		rec := httptest.NewRecorder()
+		r.Direct(log.New(ioutil.Discard, "", 0), req, upstream).ServeHTTP(rec, req)
+		if rec.Code != test.expected {
+			t.Errorf("Status for %s %s with %+v was incorrect, got %d, want %d", test.method, test.target, test.global, rec.Code, test.expected)
+		}
+		if forwarded != test.forwarded {
+			t.Errorf("Forwarded %s for %s %s with %+v, expected %s", forwarded, test.method, test.target, test.global, test.forwarded)
+		}
+	}
+}
+
+func TestPingAPIVersion(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("API-Version", "1.43")
+		_, _ = w.Write([]byte("OK"))
+	})
+
+	tests := []struct {
+		c        *config.APIVersion
+		expected string
+	}{
+		{nil, "1.43"},
+		{&config.APIVersion{Min: "1.30"}, "1.43"},
+		{&config.APIVersion{Max: "1.41"}, "1.41"},
+		{&config.APIVersion{Max: "1.45"}, "1.43"},
+		{&config.APIVersion{Max: "1.45", Pin: "1.40"}, "1.40"},
+	}
+
+	for _, test := range tests {
+		r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{APIVersion: test.c}}
+		req := httptest.NewRequest("GET", "/_ping", nil)
+		rec := httptest.NewRecorder()
+		r.Direct(log.New(ioutil.Discard, "", 0), req, upstream).ServeHTTP(rec, req)
+		if v := rec.Header().Get("API-Version"); v != test.expected {
+			t.Errorf("API version announced with %+v is %s, expected %s", test.c, v, test.expected)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package dockerguard
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/micoud/dockerguard/config"
+	"github.com/micoud/dockerguard/socketproxy"
+)
+
+const (
+	modeSetuid = 04000
+	modeSetgid = 02000
+)
+
+var (
+	containerArchiveRegex = regexp.MustCompile(`^/containers/[^/]+/archive$`)
+)
+
+// checkArchive ... wraps upstream with checks of the path param of /containers/{id}/archive
+// and, for uploads, of every entry of the posted tarball
+func (r *RulesDirector) checkArchive(l socketproxy.Logger, method string, urlPath string, upstream http.Handler, c *config.CheckArchive) http.Handler {
+	if !containerArchiveRegex.MatchString(urlPath) {
+		return upstream
+	}
+
+	var deny = func(w http.ResponseWriter, msg string) {
+		l.Printf("Archive check: %s", msg)
+		writeError(w, msg, http.StatusForbidden)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p := req.URL.Query().Get("path")
+		if p == "" || !path.IsAbs(p) || hasDotDot(p) {
+			deny(w, fmt.Sprintf("Invalid value: '%s' for param path", p))
+			return
+		}
+		if !isAllowed(path.Clean(p), c.AllowedPaths) {
+			deny(w, fmt.Sprintf("Found forbidden value: %s for param path", p))
+			return
+		}
+
+		if method != "PUT" {
+			upstream.ServeHTTP(w, req)
+			return
+		}
+
+		body, size, err := spoolTar(req.Body, checkArchiveEntry)
+		if err != nil {
+			if _, ok := err.(tarError); ok {
+				writeBodyError(w, err)
+				return
+			}
+			deny(w, err.Error())
+			return
+		}
+		defer body.Close()
+
+		// forward the spooled tarball
+		setSpooledBody(req, body, size)
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+// checkArchiveEntry ... rejects entries that could escape the target directory
+// or create privileged files in a container
+func checkArchiveEntry(hdr *tar.Header, _ io.Reader) error {
+	switch {
+	case path.IsAbs(hdr.Name):
+		return fmt.Errorf("Entry %s has an absolute path", hdr.Name)
+	case hasDotDot(hdr.Name):
+		return fmt.Errorf("Entry %s contains '..'", hdr.Name)
+	case hdr.Typeflag == tar.TypeSymlink:
+		return fmt.Errorf("Entry %s is a symlink", hdr.Name)
+	case hdr.Typeflag == tar.TypeLink && (path.IsAbs(hdr.Linkname) || hasDotDot(hdr.Linkname)):
+		return fmt.Errorf("Entry %s is a hardlink to %s", hdr.Name, hdr.Linkname)
+	case hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock:
+		return fmt.Errorf("Entry %s is a device", hdr.Name)
+	case hdr.Mode&(modeSetuid|modeSetgid) != 0:
+		return fmt.Errorf("Entry %s has the setuid or setgid bit set", hdr.Name)
+	}
+	return nil
+}
+
+// hasDotDot ... true if p contains a '..' path element
+func hasDotDot(p string) bool {
+	for _, e := range strings.Split(p, "/") {
+		if e == ".." {
+			return true
+		}
+	}
+	return false
+}
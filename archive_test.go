@@ -0,0 +1,35 @@
+package dockerguard
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+func TestCheckArchiveEntry(t *testing.T) {
+	tests := []struct {
+		hdr     tar.Header
+		allowed bool
+	}{
+		{tar.Header{Name: "app/config.yml", Typeflag: tar.TypeReg, Mode: 0644}, true},
+		{tar.Header{Name: "app/", Typeflag: tar.TypeDir, Mode: 0755}, true},
+		{tar.Header{Name: "app/copy", Typeflag: tar.TypeLink, Linkname: "app/config.yml"}, true},
+		{tar.Header{Name: "/etc/passwd", Typeflag: tar.TypeReg, Mode: 0644}, false},
+		{tar.Header{Name: "app/../../etc/passwd", Typeflag: tar.TypeReg, Mode: 0644}, false},
+		{tar.Header{Name: "app/link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}, false},
+		{tar.Header{Name: "app/copy", Typeflag: tar.TypeLink, Linkname: "/etc/shadow"}, false},
+		{tar.Header{Name: "app/sh", Typeflag: tar.TypeReg, Mode: 04755}, false},
+		{tar.Header{Name: "app/sh", Typeflag: tar.TypeReg, Mode: 02755}, false},
+		{tar.Header{Name: "app/mem", Typeflag: tar.TypeChar}, false},
+	}
+
+	for _, test := range tests {
+		hdr := test.hdr
+		err := checkArchiveEntry(&hdr, nil)
+		if test.allowed && err != nil {
+			t.Errorf("Entry %s should be allowed: %v", hdr.Name, err)
+		}
+		if !test.allowed && err == nil {
+			t.Errorf("Entry %s should be forbidden", hdr.Name)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package dockerguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/micoud/dockerguard/socketproxy"
+)
+
+const (
+	// larger bodies and those of unknown size are spooled to a temporary file
+	maxInMemoryBody = 1 << 20
+)
+
+// limitBody ... rejects requests with bodies larger than max, chunked bodies fail
+// when reading beyond max
+func limitBody(max int64, upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ContentLength > max {
+			writeError(w, fmt.Sprintf("Request body larger than %d bytes", max), http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = socketproxy.LimitBody(req.Body, max)
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+// writeBodyError ... writes the error for a body that could not be read
+func writeBodyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, socketproxy.ErrBodyTooLarge) {
+		writeError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	writeError(w, err.Error(), http.StatusBadRequest)
+}
+
+// isJSON ... true if the body of req is decoded as JSON by docker, which
+// is the case for application/json and if no content type is given
+func isJSON(req *http.Request) bool {
+	ct := req.Header.Get("Content-Type")
+	if ct == "" {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	return err == nil && mt == "application/json"
+}
+
+// spoolFile ... temporary file for a body, it is removed already and
+// stays readable until it is closed
+func spoolFile() (*os.File, error) {
+	tmp, err := ioutil.TempFile("", "dockerguard-")
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(tmp.Name())
+	return tmp, nil
+}
+
+// bufferBody ... calls inspect with the body of req and makes it readable again for upstream,
+// small bodies are kept in memory, larger ones and those of unknown size are inspected while
+// they are spooled to a temporary file
+func bufferBody(req *http.Request, inspect func(io.Reader) error) error {
+	if req.ContentLength >= 0 && req.ContentLength <= maxInMemoryBody {
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = int64(len(data))
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+		return inspect(bytes.NewReader(data))
+	}
+
+	tmp, err := spoolFile()
+	if err != nil {
+		return err
+	}
+	err = inspect(io.TeeReader(req.Body, tmp))
+	if err == nil {
+		// spool what the inspection did not read
+		_, err = io.Copy(tmp, req.Body)
+	}
+	var size int64
+	if err == nil {
+		size, err = tmp.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	setSpooledBody(req, tmp, size)
+	return nil
+}
+
+// jsonInspector ... collects the values of keys from a JSON object while it is decoded
+// token by token, only the values of the keys are held in memory
+type jsonInspector struct {
+	dec    *json.Decoder
+	keys   [][]string
+	values [][]interface{}
+}
+
+// jsonValues ... values found under each of keys in the JSON object read from r. Like docker
+// decoding into its types keys are compared case insensitively, and every occurrence of a
+// key given more than once is returned.
+func jsonValues(r io.Reader, keys [][]string) ([][]interface{}, error) {
+	ji := &jsonInspector{
+		dec:    json.NewDecoder(r),
+		keys:   keys,
+		values: make([][]interface{}, len(keys)),
+	}
+
+	tok, err := ji.dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding JSON body: %w", err)
+	}
+	if tok != json.Delim('{') {
+		return nil, fmt.Errorf("JSON body is not an object")
+	}
+	if err := ji.object(nil); err != nil {
+		return nil, fmt.Errorf("Error decoding JSON body: %w", err)
+	}
+	if _, err := ji.dec.Token(); err != io.EOF {
+		if errors.Is(err, socketproxy.ErrBodyTooLarge) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Unexpected data after JSON body")
+	}
+
+	return ji.values, nil
+}
+
+// object ... reads the members of the object at path, its opening brace is read already
+func (ji *jsonInspector) object(path []string) error {
+	for ji.dec.More() {
+		tok, err := ji.dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		if err := ji.value(append(path[:len(path):len(path)], key)); err != nil {
+			return err
+		}
+	}
+	// closing brace
+	_, err := ji.dec.Token()
+	return err
+}
+
+// value ... reads the value at path, it is only decoded if it is one of the keys
+func (ji *jsonInspector) value(path []string) error {
+	exact, deeper := false, false
+	for _, key := range ji.keys {
+		if hasKeyPrefix(key, path) {
+			if len(key) == len(path) {
+				exact = true
+			} else {
+				deeper = true
+			}
+		}
+	}
+
+	if exact {
+		var v interface{}
+		if err := ji.dec.Decode(&v); err != nil {
+			return err
+		}
+		for i, key := range ji.keys {
+			if hasKeyPrefix(key, path) {
+				ji.values[i] = append(ji.values[i], collectNested(v, key[len(path):])...)
+			}
+		}
+		return nil
+	}
+
+	tok, err := ji.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == json.Delim('{') && deeper {
+		return ji.object(path)
+	}
+	return skipJSON(ji.dec, tok)
+}
+
+// skipJSON ... skips the rest of a value that started with tok
+func skipJSON(dec *json.Decoder, tok json.Token) error {
+	depth := 0
+	for {
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+
+		var err error
+		if tok, err = dec.Token(); err != nil {
+			return err
+		}
+	}
+}
+
+// hasKeyPrefix ... true if key starts with path, ignoring case
+func hasKeyPrefix(key []string, path []string) bool {
+	if len(key) < len(path) {
+		return false
+	}
+	for i := range path {
+		if !strings.EqualFold(key[i], path[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// collectNested ... values under keys in v, ignoring case
+func collectNested(v interface{}, keys []string) []interface{} {
+	if len(keys) == 0 {
+		return []interface{}{v}
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	var values []interface{}
+	for k, mv := range m {
+		if strings.EqualFold(k, keys[0]) {
+			values = append(values, collectNested(mv, keys[1:])...)
+		}
+	}
+	return values
+}
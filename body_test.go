@@ -0,0 +1,134 @@
+package dockerguard
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/micoud/dockerguard/config"
+)
+
+func TestJSONValues(t *testing.T) {
+	keys := [][]string{{"Image"}, {"HostConfig", "Privileged"}}
+
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{`{"Image": "nginx", "HostConfig": {"Privileged": false}}`, `[[nginx] [false]]`},
+		{`{"image": "nginx", "hostconfig": {"PRIVILEGED": true}}`, `[[nginx] [true]]`},
+		{`{"Image": "nginx", "Image": "evil"}`, `[[nginx evil] []]`},
+		{`{"HostConfig": {"Privileged": false}, "HostConfig": {"Privileged": true}}`, `[[] [false true]]`},
+		{`{"Labels": {"HostConfig": {"Privileged": true}}, "Cmd": ["Image"]}`, `[[] []]`},
+		{`{"HostConfig": null}`, `[[] []]`},
+		{`{}`, `[[] []]`},
+	}
+
+	for _, test := range tests {
+		values, err := jsonValues(strings.NewReader(test.body), keys)
+		if err != nil {
+			t.Errorf("Inspecting %s failed: %v", test.body, err)
+			continue
+		}
+		if fmt.Sprint(values) != test.expected {
+			t.Errorf("Values of %s are %v, expected %s", test.body, values, test.expected)
+		}
+	}
+
+	for _, body := range []string{``, `[]`, `"Image"`, `{"Image": }`, `{"Image": "nginx"`, `{} {}`, `{"Image": "nginx"} x`} {
+		if _, err := jsonValues(strings.NewReader(body), keys); err == nil {
+			t.Errorf("Inspecting %q should have failed", body)
+		}
+	}
+}
+
+func TestBodyChecks(t *testing.T) {
+	r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{
+		Routes: []config.Route{
+			{Method: "POST", Pattern: "^/containers/create$", MaxBodySize: 128, CheckJSON: []config.CheckJSON{
+				{Key: []string{"HostConfig", "Privileged"}, AllowedValues: []interface{}{false}},
+			}},
+			{Method: "POST", Pattern: "^/build$"},
+		},
+	}}
+	var forwarded string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		forwarded = string(body)
+	})
+
+	tests := []struct {
+		path        string
+		contentType string
+		body        string
+		chunked     bool
+		expected    int
+	}{
+		{"/containers/create", "application/json", `{"HostConfig": {"Privileged": false}, "Memory": 12345678901234567890}`, false, http.StatusOK},
+		{"/containers/create", "application/json", `{"Env": ["` + strings.Repeat("x", 128) + `"]}`, false, http.StatusRequestEntityTooLarge},
+		{"/containers/create", "application/json", `{"hostconfig": {"privileged": true}}`, false, http.StatusUnauthorized},
+		{"/containers/create", "application/json", `{"HostConfig": {}, "HostConfig": {"Privileged": true}}`, false, http.StatusUnauthorized},
+		{"/containers/create", "", `{"HostConfig": {"Privileged": true}}`, false, http.StatusUnauthorized},
+		{"/containers/create", "application/json; charset=utf-8", `{"HostConfig": {"Privileged": true}}`, true, http.StatusUnauthorized},
+		{"/containers/create", "application/json", `{"HostConfig": {"Privileged": false}} {}`, false, http.StatusBadRequest},
+		{"/containers/create", "application/json", `{"Env": ["` + strings.Repeat("x", 128) + `"]}`, true, http.StatusRequestEntityTooLarge},
+		{"/build", "application/x-tar", strings.Repeat("x", maxInMemoryBody+1), true, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		forwarded = ""
+		req := httptest.NewRequest("POST", test.path, strings.NewReader(test.body))
+		if test.chunked {
+			req.ContentLength = -1
+			req.Body = ioutil.NopCloser(strings.NewReader(test.body))
+		}
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		rec := httptest.NewRecorder()
+		r.Direct(log.New(ioutil.Discard, "", 0), req, upstream).ServeHTTP(rec, req)
+		if rec.Code != test.expected {
+			t.Errorf("Status for %s was incorrect, got %d, want %d", test.body, rec.Code, test.expected)
+		}
+		// upstream gets the body as it was sent
+		if rec.Code == http.StatusOK && forwarded != test.body {
+			t.Errorf("Forwarded body of %d bytes differs from the %d bytes sent", len(forwarded), len(test.body))
+		}
+	}
+}
+
+func TestBufferBodySpooled(t *testing.T) {
+	body := `{"Image": "nginx", "Labels": {"data": "` + strings.Repeat("x", maxInMemoryBody) + `"}}`
+	req := httptest.NewRequest("POST", "/containers/create", nil)
+	req.ContentLength = -1
+	req.Body = ioutil.NopCloser(strings.NewReader(body))
+
+	var values [][]interface{}
+	err := bufferBody(req, func(r io.Reader) (err error) {
+		values, err = jsonValues(r, [][]string{{"Image"}})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer req.Body.Close()
+
+	if fmt.Sprint(values) != "[[nginx]]" {
+		t.Errorf("Unexpected values %v", values)
+	}
+	if req.ContentLength != int64(len(body)) {
+		t.Errorf("Content length of the spooled body is %d, expected %d", req.ContentLength, len(body))
+	}
+	if data, _ := ioutil.ReadAll(req.Body); string(data) != body {
+		t.Errorf("Spooled body differs from the body sent")
+	}
+}
@@ -0,0 +1,388 @@
+package dockerguard
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/micoud/dockerguard/config"
+	"github.com/micoud/dockerguard/socketproxy"
+)
+
+const (
+	defaultDockerfile = "Dockerfile"
+	maxDockerfileSize = 1 << 20
+)
+
+var (
+	escapeDirectiveRegex = regexp.MustCompile(`^#\s*escape\s*=\s*(\S)\s*$`)
+	stageIndexRegex      = regexp.MustCompile(`^\d+$`)
+)
+
+// instruction ... single instruction of a Dockerfile, e.g. 'COPY --from=builder /app /app'
+// is split into 'COPY', ['--from=builder'] and '/app /app'
+type instruction struct {
+	Cmd   string
+	Flags []string
+	Args  string
+	Line  int
+}
+
+// flag ... returns the value of flag name (without leading dashes) and whether it is set
+func (i instruction) flag(name string) (string, bool) {
+	for _, f := range i.Flags {
+		kv := strings.SplitN(strings.TrimPrefix(f, "--"), "=", 2)
+		if strings.ToLower(kv[0]) == name {
+			if len(kv) == 2 {
+				return kv[1], true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// parseInstruction ... splits a single instruction starting at line into its parts
+func parseInstruction(s string, line int) instruction {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return instruction{Line: line}
+	}
+	inst := instruction{Cmd: strings.ToUpper(fields[0]), Line: line}
+	fields = fields[1:]
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+		inst.Flags = append(inst.Flags, fields[0])
+		fields = fields[1:]
+	}
+	inst.Args = strings.Join(fields, " ")
+	return inst
+}
+
+// wrapped ... the instruction wrapped by ONBUILD, e.g. 'RUN --network=host true' of
+// 'ONBUILD RUN --network=host true'
+func (i instruction) wrapped() instruction {
+	return parseInstruction(strings.Join(append(i.Flags[:len(i.Flags):len(i.Flags)], i.Args), " "), i.Line)
+}
+
+// parseDockerfile ... splits a Dockerfile into instructions, handling comments,
+// line continuations and the escape parser directive
+func parseDockerfile(r io.Reader) ([]instruction, error) {
+	var instructions []instruction
+	var escape = `\`
+	var current string
+	var start int
+	var directives = true
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxDockerfileSize)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		// parser directives are only allowed before anything else
+		if directives {
+			if m := escapeDirectiveRegex.FindStringSubmatch(line); m != nil {
+				escape = m[1]
+				continue
+			}
+			if !strings.HasPrefix(line, "#") || line == "#" {
+				directives = false
+			}
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if current == "" {
+			start = n
+		}
+		if strings.HasSuffix(line, escape) {
+			current += strings.TrimSuffix(line, escape) + " "
+			continue
+		}
+		current += line
+
+		instructions = append(instructions, parseInstruction(current, start))
+		current = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != "" {
+		return nil, fmt.Errorf("Dockerfile ends with a line continuation")
+	}
+
+	return instructions, nil
+}
+
+// expandArgs ... substitutes $NAME, ${NAME}, ${NAME:-default} and ${NAME:+value}
+// with build args, unknown args are replaced by an empty string
+func expandArgs(s string, args map[string]string) string {
+	return os.Expand(s, func(name string) string {
+		if i := strings.Index(name, ":-"); i >= 0 {
+			if v := args[name[:i]]; v != "" {
+				return v
+			}
+			return name[i+2:]
+		}
+		if i := strings.Index(name, ":+"); i >= 0 {
+			if args[name[:i]] != "" {
+				return name[i+2:]
+			}
+			return ""
+		}
+		return args[name]
+	})
+}
+
+// isForbidden ... true if inst matches a forbidden instruction like 'ADD' or 'RUN --network=host',
+// every flag given after the instruction name has to prefix one of the flags of inst
+func isForbidden(inst instruction, forbidden string) bool {
+	fields := strings.Fields(forbidden)
+	if len(fields) == 0 || strings.ToUpper(fields[0]) != inst.Cmd {
+		return false
+	}
+	for _, ff := range fields[1:] {
+		found := false
+		for _, f := range inst.Flags {
+			if strings.HasPrefix(strings.ToLower(f), strings.ToLower(ff)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// checkBuild ... wraps upstream with checks of the JSON encoded params of POST /build
+// and of the Dockerfile found in the build context that is posted as tarball
+func (r *RulesDirector) checkBuild(l socketproxy.Logger, upstream http.Handler, c *config.CheckBuild) http.Handler {
+	var deny = func(w http.ResponseWriter, msg string) {
+		l.Printf("Build check: %s", msg)
+		writeError(w, msg, http.StatusForbidden)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+
+		if q.Get("remote") != "" {
+			deny(w, "Remote build contexts cannot be inspected")
+			return
+		}
+		if q.Get("version") == "2" {
+			deny(w, "BuildKit build contexts cannot be inspected")
+			return
+		}
+
+		// check JSON encoded params
+		var buildArgs map[string]interface{}
+		var labels map[string]interface{}
+		var cacheFrom []interface{}
+		for param, v := range map[string]interface{}{"buildargs": &buildArgs, "labels": &labels, "cachefrom": &cacheFrom} {
+			if qp := q.Get(param); qp != "" {
+				if err := json.Unmarshal([]byte(qp), v); err != nil {
+					writeError(w, fmt.Sprintf("Error decoding param %s: %v", param, err), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		args := map[string]string{}
+		for k, v := range buildArgs {
+			s, _ := v.(string)
+			args[k] = s
+			if c.BuildArgs != nil && !isAllowed(k+"="+s, c.BuildArgs) {
+				deny(w, fmt.Sprintf("Found forbidden value: %s for param buildargs", k+"="+s))
+				return
+			}
+		}
+		for k, v := range labels {
+			s, _ := v.(string)
+			if c.Labels != nil && !isAllowed(k+"="+s, c.Labels) {
+				deny(w, fmt.Sprintf("Found forbidden value: %s for param labels", k+"="+s))
+				return
+			}
+		}
+		for _, v := range cacheFrom {
+			if c.CacheFrom != nil && !isAllowed(v, c.CacheFrom) {
+				deny(w, fmt.Sprintf("Found forbidden value: %v for param cachefrom", v))
+				return
+			}
+		}
+
+		// find the Dockerfile in the build context
+		dockerfile := q.Get("dockerfile")
+		if dockerfile == "" {
+			dockerfile = defaultDockerfile
+		}
+		dockerfile = path.Clean(dockerfile)
+
+		var instructions []instruction
+		var found bool
+		body, size, err := spoolTar(req.Body, func(hdr *tar.Header, tr io.Reader) error {
+			if path.Clean(hdr.Name) != dockerfile {
+				return nil
+			}
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+				return fmt.Errorf("Dockerfile %s is not a regular file", dockerfile)
+			}
+			if hdr.Size > maxDockerfileSize {
+				return fmt.Errorf("Dockerfile %s exceeds %d bytes", dockerfile, maxDockerfileSize)
+			}
+
+			var err error
+			instructions, err = parseDockerfile(tr)
+			if err != nil {
+				return fmt.Errorf("Error parsing Dockerfile: %w", err)
+			}
+			found = true
+			return nil
+		})
+		if err != nil {
+			// the body might exceed its limit while the Dockerfile is read
+			if _, ok := err.(tarError); ok || errors.Is(err, socketproxy.ErrBodyTooLarge) {
+				writeBodyError(w, err)
+				return
+			}
+			deny(w, err.Error())
+			return
+		}
+		defer body.Close()
+
+		if !found {
+			deny(w, fmt.Sprintf("Dockerfile %s not found in build context", dockerfile))
+			return
+		}
+		if err := r.checkInstructions(instructions, args, c); err != nil {
+			deny(w, err.Error())
+			return
+		}
+
+		// forward the spooled build context
+		setSpooledBody(req, body, size)
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+// checkInstructions ... checks the instructions of a Dockerfile for forbidden instructions
+// and base images that are not allowed, args contains the build args of the request
+func (r *RulesDirector) checkInstructions(instructions []instruction, args map[string]string, c *config.CheckBuild) error {
+	stages := map[string]bool{}
+	globalArgs := map[string]string{}
+	seenFrom := false
+
+	// build args override the defaults of ARG instructions
+	var withDefaults = func(defaults map[string]string) map[string]string {
+		merged := map[string]string{}
+		for k, v := range defaults {
+			merged[k] = v
+		}
+		for k, v := range args {
+			merged[k] = v
+		}
+		return merged
+	}
+
+	var checkImage = func(inst instruction, image string) error {
+		if strings.ToLower(image) == "scratch" || stages[strings.ToLower(image)] {
+			return nil
+		}
+		if err := r.checkBaseImage(image, c); err != nil {
+			return fmt.Errorf("Line %d: %v", inst.Line, err)
+		}
+		return nil
+	}
+
+	// COPY --from can reference other stages or arbitrary images
+	var checkCopyFrom = func(inst instruction) error {
+		if from, ok := inst.flag("from"); ok && !stageIndexRegex.MatchString(from) {
+			return checkImage(inst, expandArgs(from, withDefaults(globalArgs)))
+		}
+		return nil
+	}
+
+	for _, inst := range instructions {
+		// ONBUILD instructions run in builds based on the image, they are checked like
+		// the instruction they wrap as well
+		checked := []instruction{inst}
+		if inst.Cmd == "ONBUILD" {
+			checked = append(checked, inst.wrapped())
+		}
+		for _, i := range checked {
+			for _, f := range c.ForbiddenInstructions {
+				if isForbidden(i, f) {
+					return fmt.Errorf("Line %d: instruction '%s' is forbidden", inst.Line, f)
+				}
+			}
+		}
+
+		switch inst.Cmd {
+		case "ARG":
+			// only ARGs before the first FROM can be used in FROM
+			if !seenFrom {
+				for _, a := range strings.Fields(inst.Args) {
+					kv := strings.SplitN(a, "=", 2)
+					if len(kv) == 2 {
+						globalArgs[kv[0]] = strings.Trim(kv[1], `"'`)
+					} else {
+						globalArgs[kv[0]] = ""
+					}
+				}
+			}
+		case "FROM":
+			seenFrom = true
+			fields := strings.Fields(expandArgs(inst.Args, withDefaults(globalArgs)))
+			if len(fields) == 0 {
+				return fmt.Errorf("Line %d: FROM without image", inst.Line)
+			}
+			if err := checkImage(inst, fields[0]); err != nil {
+				return err
+			}
+			if len(fields) == 3 && strings.ToLower(fields[1]) == "as" {
+				stages[strings.ToLower(fields[2])] = true
+			}
+		case "COPY":
+			if err := checkCopyFrom(inst); err != nil {
+				return err
+			}
+		case "ONBUILD":
+			if w := inst.wrapped(); w.Cmd == "COPY" {
+				if err := checkCopyFrom(w); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if !seenFrom {
+		return fmt.Errorf("Dockerfile contains no FROM instruction")
+	}
+
+	return nil
+}
+
+// checkBaseImage ... checks an image used in a build against allowed_from and the images policy
+func (r *RulesDirector) checkBaseImage(image string, c *config.CheckBuild) error {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return err
+	}
+	if c.AllowedFrom != nil && !isAllowed(ref.String(), c.AllowedFrom) {
+		return fmt.Errorf("Base image %s is not allowed", ref.String())
+	}
+	if r.RoutesAllowed.Images != nil {
+		return checkImageSource(r.RoutesAllowed.Images, ref)
+	}
+	return nil
+}
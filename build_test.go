@@ -0,0 +1,179 @@
+package dockerguard
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/micoud/dockerguard/config"
+)
+
+func TestParseDockerfile(t *testing.T) {
+	dockerfile := `# escape=\
+ARG BASE=alpine:3.12
+FROM ${BASE} AS builder
+# a comment
+RUN apk add --no-cache \
+    git \
+    make
+COPY --from=builder --chown=1000 /app /app
+`
+	instructions, err := parseDockerfile(strings.NewReader(dockerfile))
+	if err != nil {
+		t.Fatalf("Parsing Dockerfile failed: %v", err)
+	}
+	if len(instructions) != 4 {
+		t.Fatalf("Expected 4 instructions, got %d", len(instructions))
+	}
+	if instructions[2].Cmd != "RUN" || instructions[2].Args != "apk add --no-cache git make" || instructions[2].Line != 5 {
+		t.Errorf("RUN was parsed incorrectly: %+v", instructions[2])
+	}
+	if from, ok := instructions[3].flag("from"); !ok || from != "builder" {
+		t.Errorf("COPY --from was parsed incorrectly: %+v", instructions[3])
+	}
+}
+
+func TestCheckInstructions(t *testing.T) {
+	r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{}}
+	c := &config.CheckBuild{
+		AllowedFrom:           []interface{}{`^docker\.io/library/alpine:`},
+		ForbiddenInstructions: []string{"ADD", "RUN --network=host"},
+	}
+
+	tests := []struct {
+		dockerfile string
+		args       map[string]string
+		allowed    bool
+	}{
+		{"FROM alpine:3.12\nRUN true", nil, true},
+		{"FROM alpine:3.12 AS builder\nFROM builder\nCOPY --from=builder /a /a", nil, true},
+		{"FROM scratch\nCOPY --from=0 /a /a", nil, true},
+		{"ARG BASE=alpine:3.12\nFROM $BASE", nil, true},
+		{"ARG BASE=alpine:3.12\nFROM $BASE", map[string]string{"BASE": "ubuntu:20.04"}, false},
+		{"FROM ubuntu:20.04", nil, false},
+		{"FROM alpine", nil, false},
+		{"FROM alpine:3.12\nCOPY --from=ubuntu:20.04 /a /a", nil, false},
+		{"FROM alpine:3.12\nadd http://example.com/x /x", nil, false},
+		{"FROM alpine:3.12\nRUN --network=host true", nil, false},
+		{"FROM alpine:3.12\nONBUILD RUN true", nil, true},
+		{"FROM alpine:3.12\nONBUILD RUN --network=host true", nil, false},
+		{"FROM alpine:3.12\nonbuild add http://example.com/x /x", nil, false},
+		{"FROM alpine:3.12\nONBUILD COPY --from=alpine:3.12 /a /a", nil, true},
+		{"FROM alpine:3.12\nONBUILD COPY --from=ubuntu:20.04 /a /a", nil, false},
+		{"RUN true", nil, false},
+	}
+
+	for _, test := range tests {
+		instructions, err := parseDockerfile(strings.NewReader(test.dockerfile))
+		if err != nil {
+			t.Errorf("Parsing '%s' failed: %v", test.dockerfile, err)
+			continue
+		}
+		err = r.checkInstructions(instructions, test.args, c)
+		if test.allowed && err != nil {
+			t.Errorf("Dockerfile '%s' should be allowed: %v", test.dockerfile, err)
+		}
+		if !test.allowed && err == nil {
+			t.Errorf("Dockerfile '%s' should be forbidden", test.dockerfile)
+		}
+	}
+}
+
+// bzip2Context ... build context with a Dockerfile 'FROM alpine:3.12' compressed with
+// bzip2, there is no writer for it in the standard library
+const bzip2Context = "QlpoOTFBWSZTWUOpJcYAAG//gMqQIABAAX2QBQKRAGst3gAICCAAdRCmgPUA02oZAG0mgkojTUwNQyYCYRh1jMNQgfGhCIv0HlMzpECGBU0+eYOaxEbBA1QgqhZYmd5lKTDi1zqgy+R6Ju+CQhIhSsjGKxEQOxdyRThQkEOpJcY="
+
+func TestCheckBuild(t *testing.T) {
+	r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{}}
+	c := &config.CheckBuild{
+		AllowedFrom: []interface{}{`^docker\.io/library/alpine:`},
+		BuildArgs:   []interface{}{`^VERSION=`},
+		Labels:      []interface{}{`^team=`},
+		CacheFrom:   []interface{}{`^registry\.example\.com/`},
+	}
+
+	dockerfile := "FROM alpine:3.12\n"
+	plain := tarball(t, "Dockerfile", dockerfile, "app/main.go", "package main").Bytes()
+	custom := tarball(t, "build/Dockerfile.ci", dockerfile).Bytes()
+	forbidden := tarball(t, "Dockerfile", "FROM ubuntu:20.04\n").Bytes()
+	large := tarball(t, "Dockerfile", dockerfile+strings.Repeat("# comment\n", 1000)).Bytes()
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, _ = gw.Write(plain)
+	_ = gw.Close()
+	bzipped, err := base64.StdEncoding.DecodeString(bzip2Context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		query    url.Values
+		body     []byte
+		maxBody  int64
+		expected int
+	}{
+		{"plain", nil, plain, 0, http.StatusOK},
+		{"gzip", nil, gzipped.Bytes(), 0, http.StatusOK},
+		{"bzip2", nil, bzipped, 0, http.StatusOK},
+		{"remote", url.Values{"remote": {"https://example.com/app.git"}}, plain, 0, http.StatusForbidden},
+		{"buildkit", url.Values{"version": {"2"}}, plain, 0, http.StatusForbidden},
+		{"custom dockerfile", url.Values{"dockerfile": {"build/Dockerfile.ci"}}, custom, 0, http.StatusOK},
+		{"custom dockerfile missing", url.Values{"dockerfile": {"build/Dockerfile.ci"}}, plain, 0, http.StatusForbidden},
+		{"dockerfile missing", nil, custom, 0, http.StatusForbidden},
+		{"base image", nil, forbidden, 0, http.StatusForbidden},
+		{"buildargs", url.Values{"buildargs": {`{"VERSION":"1.0"}`}}, plain, 0, http.StatusOK},
+		{"buildargs forbidden", url.Values{"buildargs": {`{"HTTP_PROXY":"http://proxy"}`}}, plain, 0, http.StatusForbidden},
+		{"buildargs invalid", url.Values{"buildargs": {`{`}}, plain, 0, http.StatusBadRequest},
+		{"labels", url.Values{"labels": {`{"team":"ci"}`}}, plain, 0, http.StatusOK},
+		{"labels forbidden", url.Values{"labels": {`{"owner":"ci"}`}}, plain, 0, http.StatusForbidden},
+		{"cachefrom", url.Values{"cachefrom": {`["registry.example.com/app:1.0"]`}}, plain, 0, http.StatusOK},
+		{"cachefrom forbidden", url.Values{"cachefrom": {`["evil.example/app:1.0"]`}}, plain, 0, http.StatusForbidden},
+		{"not a tarball", nil, []byte("FROM alpine:3.12"), 0, http.StatusBadRequest},
+		// the limit is hit while the Dockerfile is read
+		{"too large", nil, large, 2048, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		var forwarded []byte
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			forwarded, _ = ioutil.ReadAll(req.Body)
+		})
+		var handler http.Handler = r.checkBuild(log.New(ioutil.Discard, "", 0), upstream, c)
+		if test.maxBody > 0 {
+			handler = limitBody(test.maxBody, handler)
+		}
+
+		req := httptest.NewRequest("POST", "/build?"+test.query.Encode(), bytes.NewReader(test.body))
+		req.Header.Set("Content-Type", "application/x-tar")
+		// chunked, so that the limit is hit while reading
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.expected {
+			t.Errorf("Status for %s was incorrect, got %d, want %d: %s", test.name, rec.Code, test.expected, rec.Body)
+			continue
+		}
+		// the spooled context is forwarded as it was sent
+		if rec.Code == http.StatusOK && !bytes.Equal(forwarded, test.body) {
+			t.Errorf("Context of %s was changed, forwarded %d bytes, sent %d", test.name, len(forwarded), len(test.body))
+		}
+	}
+
+	// an empty list allows no value at all
+	empty := &config.CheckBuild{Labels: []interface{}{}}
+	req := httptest.NewRequest("POST", "/build?labels="+url.QueryEscape(`{"team":"ci"}`), bytes.NewReader(plain))
+	rec := httptest.NewRecorder()
+	r.checkBuild(log.New(ioutil.Discard, "", 0), http.NotFoundHandler(), empty).ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Label should be forbidden by an empty list, got %d", rec.Code)
+	}
+}
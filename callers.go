@@ -0,0 +1,386 @@
+package dockerguard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/micoud/dockerguard/config"
+	"github.com/micoud/dockerguard/socketproxy"
+)
+
+const (
+	// unknown IPs trigger a refresh at most this often
+	minCallerRefresh = time.Second
+	// timeout for the requests of a refresh to the upstream daemon
+	callerLookupTimeout = 5 * time.Second
+	// unknown IPs that are remembered, expired ones are dropped once there are more
+	maxUnknownCallers = 4096
+
+	labelSwarmService   = "com.docker.swarm.service.name"
+	labelStackNamespace = "com.docker.stack.namespace"
+	labelComposeService = "com.docker.compose.service"
+	labelComposeProject = "com.docker.compose.project"
+)
+
+var (
+	callerPlaceholderRegex = regexp.MustCompile(`\$\{caller\.([^}]+)\}`)
+)
+
+// containerInfo ... what is known about a container calling from one of the networks
+type containerInfo struct {
+	Name    string
+	Service string
+	Stack   string
+	Labels  map[string]string
+}
+
+// callerResolver ... maps source IPs to containers by inspecting networks upstream
+type callerResolver struct {
+	client   *http.Client
+	networks []string
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	byIP      map[string]*containerInfo
+	byID      map[string]*containerInfo
+	refreshed time.Time
+	// IPs that were not found, they do not trigger a refresh again until the ttl passed
+	unknown map[string]time.Time
+	// closed when the running refresh is done, nil if none is running
+	refreshing chan struct{}
+}
+
+func newCallerResolver(client *http.Client, c *config.CallerLookup) *callerResolver {
+	return &callerResolver{
+		client:   client,
+		networks: c.Networks,
+		ttl:      c.TTL(),
+		byIP:     map[string]*containerInfo{},
+		byID:     map[string]*containerInfo{},
+		unknown:  map[string]time.Time{},
+	}
+}
+
+// lookup ... returns the container with the IP of remoteAddr, or nil if it is unknown
+func (cr *callerResolver) lookup(l socketproxy.Logger, remoteAddr string) *containerInfo {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	key := ip.String()
+
+	cr.mu.Lock()
+	stale := time.Since(cr.refreshed) > cr.ttl
+	info, ok := cr.byIP[key]
+	seen, unknown := cr.unknown[key]
+	// the container might have been started since the last refresh
+	retry := !ok && (!unknown || time.Since(seen) > cr.ttl) && time.Since(cr.refreshed) > minCallerRefresh
+	cr.mu.Unlock()
+
+	if !stale && !retry {
+		return info
+	}
+
+	cr.refreshOnce(l)
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	info, ok = cr.byIP[key]
+	if !ok {
+		cr.rememberUnknown(key)
+	}
+	return info
+}
+
+// refreshOnce ... refreshes the IP map or waits for the refresh that is running, the
+// requests to upstream are done without holding the lock so that lookups of known IPs
+// are not blocked by them
+func (cr *callerResolver) refreshOnce(l socketproxy.Logger) {
+	cr.mu.Lock()
+	if done := cr.refreshing; done != nil {
+		cr.mu.Unlock()
+		<-done
+		return
+	}
+	done := make(chan struct{})
+	cr.refreshing = done
+	known := cr.byID
+	cr.mu.Unlock()
+
+	byIP, byID := cr.refresh(l, known)
+
+	cr.mu.Lock()
+	cr.byIP = byIP
+	cr.byID = byID
+	cr.refreshed = time.Now()
+	cr.refreshing = nil
+	cr.mu.Unlock()
+	close(done)
+}
+
+// rememberUnknown ... remembers an IP that was not found, cr.mu has to be held
+func (cr *callerResolver) rememberUnknown(key string) {
+	if len(cr.unknown) >= maxUnknownCallers {
+		for ip, seen := range cr.unknown {
+			if time.Since(seen) > cr.ttl {
+				delete(cr.unknown, ip)
+			}
+		}
+		if len(cr.unknown) >= maxUnknownCallers {
+			cr.unknown = map[string]time.Time{}
+		}
+	}
+	cr.unknown[key] = time.Now()
+}
+
+// refresh ... builds the IP map from the endpoints of the configured networks, containers
+// on this node come with their labels, tasks on other nodes with those of their service.
+// Containers in known are not inspected again.
+func (cr *callerResolver) refresh(l socketproxy.Logger, known map[string]*containerInfo) (map[string]*containerInfo, map[string]*containerInfo) {
+	ctx, cancel := context.WithTimeout(context.Background(), callerLookupTimeout)
+	defer cancel()
+
+	byIP := map[string]*containerInfo{}
+	byID := map[string]*containerInfo{}
+	services := map[string]*containerInfo{}
+
+	for _, network := range cr.networks {
+		var inspect struct {
+			Containers map[string]struct {
+				Name        string
+				IPv4Address string
+				IPv6Address string
+			}
+			Services map[string]struct {
+				Tasks []struct {
+					Name       string
+					EndpointIP string
+				}
+			}
+		}
+		if err := cr.get(ctx, "/networks/"+url.PathEscape(network)+"?verbose=true", &inspect); err != nil {
+			l.Printf("Error inspecting network %s: %v", network, err)
+			continue
+		}
+
+		for name, svc := range inspect.Services {
+			info, ok := services[name]
+			if !ok {
+				info = cr.inspectService(ctx, l, name)
+				services[name] = info
+			}
+			for _, task := range svc.Tasks {
+				if info != nil && task.EndpointIP != "" {
+					taskInfo := *info
+					taskInfo.Name = task.Name
+					byIP[task.EndpointIP] = &taskInfo
+				}
+			}
+		}
+
+		for id, c := range inspect.Containers {
+			info, ok := known[id]
+			if !ok {
+				info = cr.inspectContainer(ctx, l, id)
+				if info == nil {
+					continue
+				}
+			}
+			byID[id] = info
+			for _, addr := range []string{c.IPv4Address, c.IPv6Address} {
+				if ip, _, err := net.ParseCIDR(addr); err == nil {
+					byIP[ip.String()] = info
+				}
+			}
+		}
+	}
+
+	return byIP, byID
+}
+
+// inspectContainer ... reads name and labels of a container on this node
+func (cr *callerResolver) inspectContainer(ctx context.Context, l socketproxy.Logger, id string) *containerInfo {
+	var inspect struct {
+		Name   string
+		Config struct {
+			Labels map[string]string
+		}
+	}
+	if err := cr.get(ctx, "/containers/"+url.PathEscape(id)+"/json", &inspect); err != nil {
+		l.Printf("Error inspecting container %s: %v", id, err)
+		return nil
+	}
+
+	labels := inspect.Config.Labels
+	info := &containerInfo{
+		Name:    strings.TrimPrefix(inspect.Name, "/"),
+		Service: labels[labelSwarmService],
+		Stack:   labels[labelStackNamespace],
+		Labels:  labels,
+	}
+	if info.Service == "" {
+		info.Service = labels[labelComposeService]
+	}
+	if info.Stack == "" {
+		info.Stack = labels[labelComposeProject]
+	}
+
+	return info
+}
+
+// inspectService ... reads the labels of a swarm service and of its containers
+func (cr *callerResolver) inspectService(ctx context.Context, l socketproxy.Logger, name string) *containerInfo {
+	var inspect struct {
+		Spec struct {
+			Name         string
+			Labels       map[string]string
+			TaskTemplate struct {
+				ContainerSpec struct {
+					Labels map[string]string
+				}
+			}
+		}
+	}
+	if err := cr.get(ctx, "/services/"+url.PathEscape(name), &inspect); err != nil {
+		l.Printf("Error inspecting service %s: %v", name, err)
+		return nil
+	}
+
+	labels := map[string]string{}
+	for k, v := range inspect.Spec.Labels {
+		labels[k] = v
+	}
+	for k, v := range inspect.Spec.TaskTemplate.ContainerSpec.Labels {
+		labels[k] = v
+	}
+
+	return &containerInfo{
+		Service: inspect.Spec.Name,
+		Stack:   labels[labelStackNamespace],
+		Labels:  labels,
+	}
+}
+
+// get ... decodes the JSON response of the upstream daemon for path into v
+func (cr *callerResolver) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://docker"+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := cr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// expandRoute ... returns a copy of route with placeholders like ${caller.stack} replaced by
+// what is known about the calling container, ok is false if a placeholder cannot be replaced
+func (c caller) expandRoute(route config.Route) (config.Route, bool) {
+	ok := true
+
+	var expand = func(s string, quote bool) string {
+		return callerPlaceholderRegex.ReplaceAllStringFunc(s, func(p string) string {
+			v, found := c.placeholder(callerPlaceholderRegex.FindStringSubmatch(p)[1])
+			if !found {
+				ok = false
+			}
+			if quote {
+				return regexp.QuoteMeta(v)
+			}
+			return v
+		})
+	}
+
+	var expandValue func(v interface{}, quote bool) interface{}
+	expandValue = func(v interface{}, quote bool) interface{} {
+		switch vt := v.(type) {
+		case string:
+			return expand(vt, quote)
+		case map[string]interface{}:
+			m := map[string]interface{}{}
+			for k, mv := range vt {
+				m[k] = expandValue(mv, quote)
+			}
+			return m
+		}
+		return v
+	}
+	var expandValues = func(values []interface{}, quote bool) []interface{} {
+		if values == nil {
+			return nil
+		}
+		expanded := make([]interface{}, len(values))
+		for i, v := range values {
+			expanded[i] = expandValue(v, quote)
+		}
+		return expanded
+	}
+
+	route.Pattern = expand(route.Pattern, true)
+
+	route.AppendFilter = append([]config.AppendFilter(nil), route.AppendFilter...)
+	for i := range route.AppendFilter {
+		route.AppendFilter[i].Values = expandValues(route.AppendFilter[i].Values, false)
+	}
+	route.CheckFilter = append([]config.CheckFilter(nil), route.CheckFilter...)
+	for i := range route.CheckFilter {
+		route.CheckFilter[i].AllowedValues = expandValues(route.CheckFilter[i].AllowedValues, true)
+	}
+	route.CheckParam = append([]config.CheckParam(nil), route.CheckParam...)
+	for i := range route.CheckParam {
+		route.CheckParam[i].AllowedValues = expandValues(route.CheckParam[i].AllowedValues, true)
+	}
+	route.CheckJSON = append([]config.CheckJSON(nil), route.CheckJSON...)
+	for i := range route.CheckJSON {
+		route.CheckJSON[i].AllowedValues = expandValues(route.CheckJSON[i].AllowedValues, true)
+	}
+	if route.CheckArchive != nil {
+		route.CheckArchive = &config.CheckArchive{
+			AllowedPaths: expandValues(route.CheckArchive.AllowedPaths, true),
+		}
+	}
+
+	return route, ok
+}
+
+// placeholder ... value of a placeholder like ${caller.label.<key>}
+func (c caller) placeholder(name string) (string, bool) {
+	if c.Container == nil {
+		return "", false
+	}
+
+	switch {
+	case name == "name":
+		return c.Container.Name, c.Container.Name != ""
+	case name == "service":
+		return c.Container.Service, c.Container.Service != ""
+	case name == "stack":
+		return c.Container.Stack, c.Container.Stack != ""
+	case strings.HasPrefix(name, "label."):
+		v, ok := c.Container.Labels[strings.TrimPrefix(name, "label.")]
+		return v, ok
+	}
+
+	return "", false
+}
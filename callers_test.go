@@ -0,0 +1,186 @@
+package dockerguard
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micoud/dockerguard/config"
+)
+
+func TestCallerResolver(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var resp interface{}
+		switch req.URL.Path {
+		case "/networks/proxy-docker":
+			resp = map[string]interface{}{
+				"Containers": map[string]interface{}{
+					"abc": map[string]string{"Name": "agent_jenkins.1.x", "IPv4Address": "10.0.1.5/24"},
+				},
+				"Services": map[string]interface{}{
+					"other_web": map[string]interface{}{
+						"Tasks": []map[string]string{{"Name": "other_web.1.y", "EndpointIP": "10.0.1.6"}},
+					},
+				},
+			}
+		case "/containers/abc/json":
+			resp = map[string]interface{}{
+				"Name": "/agent_jenkins.1.x",
+				"Config": map[string]interface{}{
+					"Labels": map[string]string{labelSwarmService: "agent_jenkins", labelStackNamespace: "agent"},
+				},
+			}
+		case "/services/other_web":
+			resp = map[string]interface{}{
+				"Spec": map[string]interface{}{
+					"Name":   "other_web",
+					"Labels": map[string]string{labelStackNamespace: "other"},
+				},
+			}
+		default:
+			http.NotFound(w, req)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer upstream.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("tcp", upstream.Listener.Addr().String())
+			},
+		},
+	}
+	cr := newCallerResolver(client, &config.CallerLookup{Networks: []string{"proxy-docker"}})
+	l := log.New(ioutil.Discard, "", 0)
+
+	info := cr.lookup(l, "10.0.1.5:43210")
+	if info == nil || info.Service != "agent_jenkins" || info.Stack != "agent" {
+		t.Errorf("Local container was resolved incorrectly: %+v", info)
+	}
+	info = cr.lookup(l, "10.0.1.6:43210")
+	if info == nil || info.Service != "other_web" || info.Stack != "other" {
+		t.Errorf("Remote task was resolved incorrectly: %+v", info)
+	}
+	if info := cr.lookup(l, "10.0.1.7:43210"); info != nil {
+		t.Errorf("Unknown IP was resolved: %+v", info)
+	}
+
+	// placeholders are replaced by the quoted values of the caller
+	route := config.Route{
+		Method:      "GET",
+		Pattern:     "^/services$",
+		CheckFilter: []config.CheckFilter{{FilterKey: "label", AllowedValues: []interface{}{"^com.docker.stack.namespace=${caller.stack}$"}}},
+	}
+	c := caller{Container: &containerInfo{Stack: "a.b"}}
+	expanded, ok := c.expandRoute(route)
+	if !ok || expanded.CheckFilter[0].AllowedValues[0] != `^com.docker.stack.namespace=a\.b$` {
+		t.Errorf("Route was expanded incorrectly: %v", expanded.CheckFilter)
+	}
+	if route.CheckFilter[0].AllowedValues[0] != "^com.docker.stack.namespace=${caller.stack}$" {
+		t.Errorf("Original route was modified: %v", route.CheckFilter)
+	}
+	if _, ok := (caller{}).expandRoute(route); ok {
+		t.Errorf("Route should not be usable for an unknown caller")
+	}
+}
+
+func TestCallerResolverRefresh(t *testing.T) {
+	var mu sync.Mutex
+	refreshes := 0
+	block := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/services/web" {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"Spec": map[string]interface{}{"Name": "web"}})
+			return
+		}
+		if req.URL.Path != "/networks/proxy-docker" {
+			http.NotFound(w, req)
+			return
+		}
+		mu.Lock()
+		refreshes++
+		n := refreshes
+		mu.Unlock()
+		if n > 1 {
+			<-block
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"Services": map[string]interface{}{
+				"web": map[string]interface{}{
+					"Tasks": []map[string]string{{"Name": "web.1.x", "EndpointIP": "10.0.1.6"}},
+				},
+			},
+		})
+	}))
+	defer upstream.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("tcp", upstream.Listener.Addr().String())
+			},
+		},
+	}
+	cr := newCallerResolver(client, &config.CallerLookup{Networks: []string{"proxy-docker"}, CacheTTL: "1h"})
+	l := log.New(ioutil.Discard, "", 0)
+	cr.lookup(l, "10.0.1.6:43210")
+
+	// an unknown IP triggers a refresh that hangs upstream
+	cr.mu.Lock()
+	cr.refreshed = time.Now().Add(-2 * minCallerRefresh)
+	cr.mu.Unlock()
+	done := make(chan *containerInfo)
+	go func() {
+		done <- cr.lookup(l, "10.0.1.7:43210")
+	}()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := refreshes
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Unknown IP did not trigger a refresh")
+		}
+	}
+
+	// known IPs are resolved in the meantime
+	resolved := make(chan *containerInfo)
+	go func() {
+		resolved <- cr.lookup(l, "10.0.1.6:43210")
+	}()
+	select {
+	case info := <-resolved:
+		if info == nil {
+			t.Errorf("Known IP was not resolved during the refresh")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Lookup of a known IP was blocked by the refresh")
+	}
+
+	close(block)
+	if info := <-done; info != nil {
+		t.Errorf("Unknown IP was resolved: %+v", info)
+	}
+
+	// the unknown IP does not trigger another refresh
+	cr.mu.Lock()
+	cr.refreshed = time.Now().Add(-2 * minCallerRefresh)
+	cr.mu.Unlock()
+	cr.lookup(l, "10.0.1.7:43210")
+	mu.Lock()
+	defer mu.Unlock()
+	if refreshes != 2 {
+		t.Errorf("Unknown IP should be remembered, got %d refreshes", refreshes)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// first file descriptor passed by systemd socket activation
+	listenFDsStart = 3
+)
+
+// listen ... listens on an address like host:port, tcp://host:port, unix:///path or
+// fd:// for a socket passed by systemd
+func listen(address string, socketMode string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(address, "tcp://"):
+		return net.Listen("tcp", strings.TrimPrefix(address, "tcp://"))
+	case strings.HasPrefix(address, "unix://"):
+		return listenUnix(strings.TrimPrefix(address, "unix://"), socketMode)
+	case strings.HasPrefix(address, "fd://"):
+		return listenFD(strings.TrimPrefix(address, "fd://"))
+	case !strings.Contains(address, "://") && strings.Contains(address, ":"):
+		return net.Listen("tcp", address)
+	}
+	return nil, fmt.Errorf("Invalid listen address %s", address)
+}
+
+var (
+	listenFDsOnce  sync.Once
+	listenFDsCount int
+)
+
+// listenFDs ... number of sockets passed by systemd, 0 if they are not meant for this process.
+// The variables are unset like sd_listen_fds does, so that child processes do not inherit them.
+func listenFDs() int {
+	listenFDsOnce.Do(func() {
+		defer func() {
+			for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+				_ = os.Unsetenv(name)
+			}
+		}()
+
+		if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+			return
+		}
+		if count, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err == nil && count > 0 {
+			listenFDsCount = count
+		}
+	})
+	return listenFDsCount
+}
+
+// listenFD ... listens on a socket passed by systemd (LISTEN_PID and LISTEN_FDS), the
+// first one unless the number of the file descriptor is given like fd://4
+func listenFD(fd string) (net.Listener, error) {
+	count := listenFDs()
+	if count < 1 {
+		return nil, fmt.Errorf("No sockets passed by systemd")
+	}
+
+	n := listenFDsStart
+	if fd != "" {
+		var err error
+		n, err = strconv.Atoi(fd)
+		if err != nil || n < listenFDsStart || n >= listenFDsStart+count {
+			return nil, fmt.Errorf("Socket fd://%s not passed by systemd", fd)
+		}
+	}
+
+	f := os.NewFile(uintptr(n), "LISTEN_FD_"+strconv.Itoa(n))
+	defer f.Close()
+
+	// the listener uses a duplicate of the file descriptor
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("Error using socket fd://%d: %v", n, err)
+	}
+	return listener, nil
+}
+
+// listenUnix ... listens on a unix socket, a stale socket file left behind
+// by a previous run is removed first
+func listenUnix(path string, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid socket mode %s: %v", mode, err)
+	}
+
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
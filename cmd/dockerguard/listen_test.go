@@ -0,0 +1,225 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// setListenFDs ... sets the variables of systemd socket activation for listenFDs to read
+func setListenFDs(pid string, fds string) {
+	listenFDsOnce, listenFDsCount = sync.Once{}, 0
+	for name, value := range map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": fds} {
+		if value == "" {
+			_ = os.Unsetenv(name)
+		} else {
+			_ = os.Setenv(name, value)
+		}
+	}
+}
+
+// passedSocket ... file descriptor of a listening socket as if it was passed by systemd,
+// it is closed by listenFD
+func passedSocket(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fd := passedSocket(t)
+	pid := strconv.Itoa(os.Getpid())
+	fds := strconv.Itoa(fd - listenFDsStart + 1)
+
+	tests := []struct {
+		address string
+		network string
+	}{
+		{"127.0.0.1:0", "tcp"},
+		{"tcp://127.0.0.1:0", "tcp"},
+		{"unix://" + filepath.Join(dir, "proxy.sock"), "unix"},
+		{"fd://" + strconv.Itoa(fd), "tcp"},
+		{"fd://" + strconv.Itoa(fd+1), ""},
+		{"fd://" + strconv.Itoa(listenFDsStart-1), ""},
+		{"fd://x", ""},
+		{"localhost", ""},
+		{"http://127.0.0.1:0", ""},
+		{"/var/run/docker.sock", ""},
+	}
+
+	for _, test := range tests {
+		setListenFDs(pid, fds)
+		l, err := listen(test.address, "0660")
+		if test.network == "" {
+			if err == nil {
+				l.Close()
+				t.Errorf("Listening on %s should fail", test.address)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Listening on %s failed: %v", test.address, err)
+			continue
+		}
+		if network := l.Addr().Network(); network != test.network {
+			t.Errorf("Network of %s was incorrect, got %s, want %s", test.address, network, test.network)
+		}
+		l.Close()
+	}
+
+	// without a number the first socket passed is used, there is none here
+	setListenFDs("", "")
+	if l, err := listen("fd://", "0660"); err == nil {
+		l.Close()
+		t.Errorf("Listening on fd:// without sockets passed by systemd should fail")
+	}
+}
+
+func TestListenFD(t *testing.T) {
+	fd := passedSocket(t)
+	pid := strconv.Itoa(os.Getpid())
+	fds := strconv.Itoa(fd - listenFDsStart + 1)
+
+	tests := []struct {
+		name    string
+		pid     string
+		fds     string
+		address string
+		valid   bool
+	}{
+		{"passed", pid, fds, "fd://" + strconv.Itoa(fd), true},
+		{"other process", strconv.Itoa(os.Getpid() + 1), fds, "fd://" + strconv.Itoa(fd), false},
+		{"no pid", "", fds, "fd://" + strconv.Itoa(fd), false},
+		{"no fds", pid, "", "fd://" + strconv.Itoa(fd), false},
+		{"zero fds", pid, "0", "fd://" + strconv.Itoa(fd), false},
+		{"invalid fds", pid, "x", "fd://" + strconv.Itoa(fd), false},
+		{"out of range", pid, strconv.Itoa(fd - listenFDsStart), "fd://" + strconv.Itoa(fd), false},
+	}
+
+	for _, test := range tests {
+		setListenFDs(test.pid, test.fds)
+		l, err := listen(test.address, "0660")
+		if err == nil {
+			l.Close()
+		}
+		if test.valid && err != nil {
+			t.Errorf("%s: listening failed: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: listening should fail", test.name)
+		}
+
+		// child processes must not inherit the sockets
+		for _, name := range []string{"LISTEN_PID", "LISTEN_FDS"} {
+			if v, ok := os.LookupEnv(name); ok {
+				t.Errorf("%s: %s=%s was not unset", test.name, name, v)
+			}
+		}
+	}
+
+	// the sockets are known after the variables were unset
+	first, second := passedSocket(t), passedSocket(t)
+	last := first
+	if second > last {
+		last = second
+	}
+	setListenFDs(pid, strconv.Itoa(last-listenFDsStart+1))
+	for _, n := range []int{first, second} {
+		l, err := listen("fd://"+strconv.Itoa(n), "0660")
+		if err != nil {
+			t.Fatalf("Listening on a passed socket after the first one failed: %v", err)
+		}
+		l.Close()
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a socket left behind by a previous run
+	stale := filepath.Join(dir, "stale.sock")
+	l, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	// other files are not removed
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		mode  string
+		perm  os.FileMode
+		valid bool
+	}{
+		{filepath.Join(dir, "proxy.sock"), "0660", 0660, true},
+		{filepath.Join(dir, "private.sock"), "600", 0600, true},
+		{stale, "0666", 0666, true},
+		{file, "0660", 0, false},
+		{filepath.Join(dir, "invalid.sock"), "0x660", 0, false},
+		{filepath.Join(dir, "invalid.sock"), "rw-rw----", 0, false},
+		{filepath.Join(dir, "missing", "proxy.sock"), "0660", 0, false},
+	}
+
+	for _, test := range tests {
+		l, err := listenUnix(test.path, test.mode)
+		if !test.valid {
+			if err == nil {
+				l.Close()
+				t.Errorf("Listening on %s with mode %s should fail", test.path, test.mode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Listening on %s failed: %v", test.path, err)
+			continue
+		}
+		fi, err := os.Stat(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != test.perm {
+			t.Errorf("Mode of %s was incorrect, got %o, want %o", test.path, fi.Mode().Perm(), test.perm)
+		}
+		l.Close()
+	}
+
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("File that is not a socket was removed: %v", err)
+	}
+}
@@ -2,15 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/micoud/dockerguard"
 	"github.com/micoud/dockerguard/config"
@@ -18,24 +25,228 @@ import (
 )
 
 var (
-	debug bool
+	debug          bool
+	healthInterval time.Duration
+	drainTimeout   time.Duration
 )
 
 func main() {
 	// read cmdline flags
 	flag.BoolVar(&debug, "debug", false, "Show debugging logging for the socket")
+	serverfile := flag.String("server-config", "", "json-file with the listeners to serve, replaces the flags -config, -upstream, -listen, -port, -socket, -tokens and -tls*")
+	metricsAddr := flag.String("metrics", "", "address to serve metrics on, e.g. localhost:9090")
 	configfile := flag.String("config", "routes.json", "json-file to read routes config from")
-	upstream := flag.String("upstream", "/var/run/docker.sock", "The path to docker socket")
+	upstream := flag.String("upstream", "unix:///var/run/docker.sock", "The docker daemon to forward to: unix:///path or tcp://host:port, several ones separated by commas for failover")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "How long to wait for running requests and streams on shutdown")
+	flag.DurationVar(&healthInterval, "upstream-health-interval", 10*time.Second, "How often to ping the upstreams if there are several ones")
+	upstreamTLS := flag.Bool("upstream-tls", false, "Use TLS to connect to a tcp upstream")
+	upstreamTLSVerify := flag.Bool("upstream-tlsverify", false, "Use TLS and verify the upstream certificate")
+	upstreamTLSCACert := flag.String("upstream-tlscacert", "", "Trust upstream certificates signed by this CA, default are the system CAs")
+	upstreamTLSCert := flag.String("upstream-tlscert", "", "Path to TLS client certificate for the upstream")
+	upstreamTLSKey := flag.String("upstream-tlskey", "", "Path to TLS client key for the upstream")
+	listenAddr := flag.String("listen", "", "address to listen on: host:port, unix:///path or fd:// for systemd socket activation, replaces -port and -socket")
 	port := flag.Int("port", 2375, "port to listen on")
+	socket := flag.String("socket", "", "path of a unix socket to listen on instead of port")
+	socketMode := flag.String("socket-mode", "0660", "file mode of the unix socket")
+	tokensfile := flag.String("tokens", "", "json-file with hashed tokens clients have to authenticate with")
+	tlsVerify := flag.Bool("tlsverify", false, "Use TLS and require client certificates signed by tlscacert")
+	tlsCACert := flag.String("tlscacert", filepath.Join(certPath(), "ca.pem"), "Trust client certificates signed by this CA")
+	tlsCert := flag.String("tlscert", filepath.Join(certPath(), "cert.pem"), "Path to TLS certificate file")
+	tlsKey := flag.String("tlskey", filepath.Join(certPath(), "key.pem"), "Path to TLS key file")
 	flag.Parse()
 
 	if debug {
 		socketproxy.Debug = true
 	}
 
+	var server config.ServerConfig
+	if *serverfile != "" {
+		server = config.ServerConfigFile(*serverfile)
+	} else {
+		// the flags describe a single listener
+		l := config.Listener{
+			Address:    "tcp://:" + strconv.Itoa(*port),
+			SocketMode: *socketMode,
+			Routes:     *configfile,
+			Upstream:   *upstream,
+			Tokens:     *tokensfile,
+		}
+		if *socket != "" {
+			l.Address = "unix://" + *socket
+		}
+		if *listenAddr != "" {
+			l.Address = *listenAddr
+		}
+		if *tlsVerify {
+			l.TLS = &config.ListenerTLS{CACert: *tlsCACert, Cert: *tlsCert, Key: *tlsKey}
+		}
+		if *upstreamTLS || *upstreamTLSVerify {
+			l.UpstreamTLS = &config.UpstreamTLS{
+				Verify: *upstreamTLSVerify,
+				CACert: *upstreamTLSCACert,
+				Cert:   *upstreamTLSCert,
+				Key:    *upstreamTLSKey,
+			}
+		}
+		server.Listeners = []config.Listener{l}
+	}
+	if *metricsAddr != "" {
+		server.MetricsAddress = *metricsAddr
+	}
+
+	var listeners []net.Listener
+	var servers []*http.Server
+	var proxies []*socketproxy.SocketProxy
+	for _, l := range server.Listeners {
+		listener, err := listen(l.Address, l.SocketMode)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if l.TLS != nil {
+			tlsConfig, err := serverTLSConfig(l.TLS.CACert, l.TLS.Cert, l.TLS.Key)
+			if err != nil {
+				log.Fatal(err)
+			}
+			listener = tls.NewListener(listener, tlsConfig)
+			fmt.Printf("Requiring client certificates signed by %s\n", l.TLS.CACert)
+		}
+
+		fmt.Printf("Listening on %s...\n", l.Address)
+		proxy := newProxy(l)
+		proxies = append(proxies, proxy)
+		listeners = append(listeners, listener)
+		servers = append(servers, &http.Server{
+			Handler:     proxy,
+			ConnContext: socketproxy.ConnContext,
+		})
+	}
+
+	if server.MetricsAddress != "" {
+		metricsListener, err := net.Listen("tcp", server.MetricsAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Serving metrics on %s/debug/vars\n", server.MetricsAddress)
+		listeners = append(listeners, metricsListener)
+		servers = append(servers, &http.Server{Handler: expvar.Handler()})
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, os.Kill, syscall.SIGTERM)
+
+	for i := range servers {
+		go func(srv *http.Server, listener net.Listener) {
+			if err := srv.Serve(listener); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}(servers[i], listeners[i])
+	}
+
+	sig := <-sigCh
+	fmt.Printf("Caught signal %s: shutting down, draining for up to %s\n", sig, drainTimeout)
+	if err := shutdown(servers, proxies, drainTimeout); err != nil {
+		log.Fatalf("Error draining connections: %v", err)
+	}
+	debugf("Drained all connections")
+}
+
+// shutdown ... stops accepting connections, then waits for running requests and
+// hijacked streams to finish within timeout
+func shutdown(servers []*http.Server, proxies []*socketproxy.SocketProxy, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			errCh <- srv.Shutdown(ctx)
+		}(srv)
+	}
+	var err error
+	for range servers {
+		if e := <-errCh; e != nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, proxy := range proxies {
+		if err := proxy.Drain(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newProxy ... proxy for the routes and upstream of a listener
+func newProxy(l config.Listener) *socketproxy.SocketProxy {
 	// read the routes config from file
-	routesAllowed := config.RoutesConfig(*configfile)
-	for _, r := range routesAllowed.Routes {
+	routesAllowed := config.RoutesConfig(l.Routes)
+	if l.Profile != "" {
+		var err error
+		routesAllowed, err = routesAllowed.ForProfile(l.Profile)
+		if err != nil {
+			log.Fatalf("Listener %s: %v", l.Name, err)
+		}
+		fmt.Printf("Listener %s uses profile %s of %s\n", l.Name, l.Profile, l.Routes)
+		printRoutes(routesAllowed.Routes)
+	} else {
+		printRoutes(routesAllowed.Routes)
+		for name, p := range routesAllowed.Profiles {
+			fmt.Printf("Profile: %s\n", name)
+			printRoutes(p.Routes)
+		}
+	}
+
+	// dial upstreamproxy
+	var tlsConfig *tls.Config
+	if l.UpstreamTLS != nil {
+		var err error
+		tlsConfig, err = socketproxy.ClientTLSConfig(l.UpstreamTLS.CACert, l.UpstreamTLS.Cert, l.UpstreamTLS.Key, l.UpstreamTLS.Verify)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	upstreams, err := socketproxy.NewUpstreams(l.Upstream, tlsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Forwarding to %s\n", upstreams)
+	if strings.Contains(l.Upstream, ",") {
+		go upstreams.HealthCheck(context.Background(), log.New(os.Stderr, "", log.LstdFlags), healthInterval)
+	}
+
+	director := &dockerguard.RulesDirector{
+		RoutesAllowed: &routesAllowed,
+		Debug:         debug,
+		Name:          l.Name,
+	}
+	proxy := socketproxy.New(upstreams, director)
+	// requests of the director to upstream share the connection pool of the proxy
+	director.Client = &http.Client{Transport: proxy.Transport}
+	proxy.Name = l.Name
+
+	if l.Tokens != "" {
+		hashes := map[string]string{}
+		for _, t := range config.TokensConfig(l.Tokens).Tokens {
+			hashes[t.SHA256] = t.Name
+		}
+		auth, err := socketproxy.NewTokenAuth(hashes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proxy.Auth = auth
+		fmt.Printf("Requiring one of %d tokens\n", len(hashes))
+	}
+
+	return proxy
+}
+
+func printRoutes(routes []config.Route) {
+	for _, r := range routes {
 		fmt.Printf("Route allowed: %s, %s \n", r.Method, r.Pattern)
 		if r.CheckJSON != nil {
 			fmt.Printf("\t JSON key to check: %v\n", r.CheckJSON)
@@ -50,43 +261,40 @@ func main() {
 			fmt.Printf("\t Filters to check: %v\n", r.CheckFilter)
 		}
 	}
+}
 
-	// dial upstreamproxy
-	proxyHTTPClient := http.Client{
-		Transport: &http.Transport{
-			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-				debugf("Dialing directly")
-				return net.Dial("unix", *upstream)
-			},
-		},
+// certPath ... directory with the TLS files, like for the docker daemon it
+// is taken from DOCKER_CERT_PATH and defaults to ~/.docker
+func certPath() string {
+	if p := os.Getenv("DOCKER_CERT_PATH"); p != "" {
+		return p
 	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker")
+}
 
-	proxy := socketproxy.New(*upstream, &dockerguard.RulesDirector{
-		Client:        &proxyHTTPClient,
-		RoutesAllowed: &routesAllowed,
-		Debug:         debug,
-	})
-
-	listener, err := net.Listen("tcp", ":"+strconv.Itoa(*port))
+// serverTLSConfig ... TLS config that requires and verifies client certificates
+func serverTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("Error loading TLS key pair: %v", err)
 	}
 
-	fmt.Printf("Listening on port " + strconv.Itoa(*port) + "...\n")
-
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, os.Kill, syscall.SIGTERM)
-
-	go func() {
-		sig := <-sigCh
-		debugf("Caught signal %s: shutting down.", sig)
-		_ = listener.Close()
-		os.Exit(0)
-	}()
-
-	if err = http.Serve(listener, proxy); err != nil {
-		log.Fatal(err)
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CA file: %v", err)
 	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("No certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
 }
 
 func debugf(format string, v ...interface{}) {
@@ -2,22 +2,236 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
 )
 
 // RoutesAllowed ... array of routes
 type RoutesAllowed struct {
-	Routes []route `json:"routes_allowed"`
+	Routes         []Route            `json:"routes_allowed"`
+	Images         *ImagePolicy       `json:"images"`
+	Profiles       map[string]Profile `json:"profiles"`
+	Identities     []Identity         `json:"identities"`
+	DefaultProfile string             `json:"default_profile"`
+	Callers        *CallerLookup      `json:"callers"`
+	AllowedSources []string           `json:"allowed_sources"`
+	APIVersion     *APIVersion        `json:"api_version"`
+	RateLimit      *RateLimit         `json:"rate_limit"`
 }
 
-type route struct {
-	Method       string         `json:"method"`
-	Pattern      string         `json:"pattern"`
-	AppendFilter []AppendFilter `json:"append_filter"`
-	CheckFilter  []CheckFilter  `json:"check_filter"`
-	CheckParam   []CheckParam   `json:"check_param"`
-	CheckJSON    []CheckJSON    `json:"check_json"`
+// CallerLookup ... struct with the networks in which the source IPs of requests
+// are looked up to identify the calling containers, and how long results are cached
+type CallerLookup struct {
+	Networks []string `json:"networks"`
+	CacheTTL string   `json:"cache_ttl"`
+}
+
+// TTL ... parsed cache_ttl, defaults to 30s
+func (c *CallerLookup) TTL() time.Duration {
+	ttl, err := time.ParseDuration(c.CacheTTL)
+	if err != nil || ttl <= 0 {
+		return 30 * time.Second
+	}
+	return ttl
+}
+
+// Route ... allowed route with the checks to do for requests matching it
+type Route struct {
+	Method         string         `json:"method"`
+	Pattern        string         `json:"pattern"`
+	AllowedSources []string       `json:"allowed_sources"`
+	AppendFilter   []AppendFilter `json:"append_filter"`
+	CheckFilter    []CheckFilter  `json:"check_filter"`
+	CheckParam     []CheckParam   `json:"check_param"`
+	CheckJSON      []CheckJSON    `json:"check_json"`
+	CheckBuild     *CheckBuild    `json:"check_build"`
+	CheckArchive   *CheckArchive  `json:"check_archive"`
+	StreamLimits   *StreamLimits  `json:"stream_limits"`
+	MaxBodySize    int64          `json:"max_body_size"`
+	APIVersion     *APIVersion    `json:"api_version"`
+	RateLimit      *RateLimit     `json:"rate_limit"`
+	Concurrency    *Concurrency   `json:"concurrency"`
+}
+
+// Concurrency ... limits how many requests of a route run at the same time in total (max) and
+// per caller or IP (max_per_caller), requests over a limit wait up to queue_timeout for a slot
+// or fail at once if it is not set, 0 means unlimited
+type Concurrency struct {
+	Max          int    `json:"max"`
+	MaxPerCaller int    `json:"max_per_caller"`
+	QueueTimeout string `json:"queue_timeout"`
+	Key          string `json:"key"`
+}
+
+// Timeout ... parsed queue_timeout
+func (c *Concurrency) Timeout() time.Duration {
+	d, _ := time.ParseDuration(c.QueueTimeout)
+	return d
+}
+
+// check ... error if the concurrency limits are not configured well
+func (c *Concurrency) check() error {
+	if c.Max < 0 || c.MaxPerCaller < 0 {
+		return fmt.Errorf("concurrency limits must not be negative")
+	}
+	if c.Max == 0 && c.MaxPerCaller == 0 {
+		return fmt.Errorf("concurrency needs max or max_per_caller")
+	}
+	if _, err := time.ParseDuration(c.QueueTimeout); c.QueueTimeout != "" && err != nil {
+		return fmt.Errorf("invalid queue_timeout: %v", err)
+	}
+	if c.Key != "" && c.Key != RateLimitKeyCaller && c.Key != RateLimitKeyIP {
+		return fmt.Errorf("unknown concurrency key '%s'", c.Key)
+	}
+	return nil
+}
+
+// RateLimit ... token bucket that allows requests per duration (default 1s) with bursts
+// of up to burst requests (default requests), there is a bucket for every caller or IP
+type RateLimit struct {
+	Requests float64 `json:"requests"`
+	Per      string  `json:"per"`
+	Burst    int     `json:"burst"`
+	Key      string  `json:"key"`
+}
+
+// Keys rate and concurrency limits can be applied by
+const (
+	RateLimitKeyCaller = "caller"
+	RateLimitKeyIP     = "ip"
+)
+
+// Rate ... requests per second
+func (r *RateLimit) Rate() float64 {
+	per, err := time.ParseDuration(r.Per)
+	if err != nil || per <= 0 {
+		per = time.Second
+	}
+	return r.Requests / per.Seconds()
+}
+
+// Size ... maximum number of requests in a burst
+func (r *RateLimit) Size() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	if r.Requests < 1 {
+		return 1
+	}
+	return int(r.Requests)
+}
+
+// check ... error if the rate limit is not configured well
+func (r *RateLimit) check() error {
+	if r.Requests <= 0 {
+		return fmt.Errorf("rate limit needs requests > 0")
+	}
+	if per, err := time.ParseDuration(r.Per); r.Per != "" && (err != nil || per <= 0) {
+		return fmt.Errorf("invalid rate limit duration '%s'", r.Per)
+	}
+	if r.Burst < 0 {
+		return fmt.Errorf("rate limit burst must not be negative")
+	}
+	if r.Key != "" && r.Key != RateLimitKeyCaller && r.Key != RateLimitKeyIP {
+		return fmt.Errorf("unknown rate limit key '%s'", r.Key)
+	}
+	return nil
+}
+
+// APIVersion ... range of API versions like 1.41 clients may use, requests are
+// rewritten to the pinned version if pin is set
+type APIVersion struct {
+	Min string `json:"min"`
+	Max string `json:"max"`
+	Pin string `json:"pin"`
+}
+
+var apiVersionRegex = regexp.MustCompile(`^(\d+)\.(\d+)$`)
+
+// CompareAPIVersions ... -1 if API version a is older than b, 1 if it is newer and 0 if both are equal
+func CompareAPIVersions(a string, b string) int {
+	ma, mb := apiVersionRegex.FindStringSubmatch(a), apiVersionRegex.FindStringSubmatch(b)
+	for i := 1; i <= 2; i++ {
+		var na, nb int
+		if ma != nil {
+			na, _ = strconv.Atoi(ma[i])
+		}
+		if mb != nil {
+			nb, _ = strconv.Atoi(mb[i])
+		}
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		}
+	}
+	return 0
+}
+
+// check ... error if a version is invalid or the pinned one is out of range
+func (v *APIVersion) check() error {
+	for _, version := range []string{v.Min, v.Max, v.Pin} {
+		if version != "" && !apiVersionRegex.MatchString(version) {
+			return fmt.Errorf("invalid API version '%s'", version)
+		}
+	}
+	if v.Min != "" && v.Max != "" && CompareAPIVersions(v.Min, v.Max) > 0 {
+		return fmt.Errorf("minimum API version %s is newer than maximum %s", v.Min, v.Max)
+	}
+	if v.Pin != "" && ((v.Min != "" && CompareAPIVersions(v.Pin, v.Min) < 0) || (v.Max != "" && CompareAPIVersions(v.Pin, v.Max) > 0)) {
+		return fmt.Errorf("pinned API version %s is out of range", v.Pin)
+	}
+	return nil
+}
+
+// StreamLimits ... limits for streams like attach and exec, max_bytes_in is what the
+// client sends (e.g. stdin), max_bytes_out what it receives, 0 means unlimited
+type StreamLimits struct {
+	IdleTimeout string `json:"idle_timeout"`
+	MaxDuration string `json:"max_duration"`
+	MaxBytesIn  int64  `json:"max_bytes_in"`
+	MaxBytesOut int64  `json:"max_bytes_out"`
+}
+
+// MinStreamTimeout ... shortest idle_timeout and max_duration of a stream, shorter ones
+// would close streams before the daemon answers
+const MinStreamTimeout = time.Second
+
+func (s *StreamLimits) check() error {
+	for _, d := range []string{s.IdleTimeout, s.MaxDuration} {
+		if d == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d)
+		if err != nil {
+			return fmt.Errorf("invalid stream limit: %v", err)
+		}
+		if duration < MinStreamTimeout {
+			return fmt.Errorf("stream limit %s is shorter than %s", d, MinStreamTimeout)
+		}
+	}
+	if s.MaxBytesIn < 0 || s.MaxBytesOut < 0 {
+		return fmt.Errorf("stream limits must not be negative")
+	}
+	return nil
+}
+
+// Idle ... parsed idle_timeout, 0 if it is not set
+func (s *StreamLimits) Idle() time.Duration {
+	d, _ := time.ParseDuration(s.IdleTimeout)
+	return d
+}
+
+// Duration ... parsed max_duration, 0 if it is not set
+func (s *StreamLimits) Duration() time.Duration {
+	d, _ := time.ParseDuration(s.MaxDuration)
+	return d
 }
 
 // AppendFilter ... struct with API filter to append values to and
@@ -35,12 +249,18 @@ type CheckFilter struct {
 }
 
 // CheckParam ... struct with URL params to check and
-// an array of allowed values
+// an array of allowed values, params with encoding 'json' are decoded
+// and the value found under key is checked
 type CheckParam struct {
 	Param         string        `json:"param"`
+	Encoding      string        `json:"encoding"`
+	Key           []string      `json:"key"`
 	AllowedValues []interface{} `json:"allowed_values"`
 }
 
+// EncodingJSON ... encoding of URL params that contain JSON
+const EncodingJSON = "json"
+
 // CheckJSON ... struct with keys and
 // an array of allowed values to check for in posted JSONs
 type CheckJSON struct {
@@ -48,6 +268,31 @@ type CheckJSON struct {
 	AllowedValues []interface{} `json:"allowed_values"`
 }
 
+// CheckBuild ... struct with rules for the Dockerfile in the build context
+// and the JSON encoded params of POST /build
+type CheckBuild struct {
+	AllowedFrom           []interface{} `json:"allowed_from"`
+	ForbiddenInstructions []string      `json:"forbidden_instructions"`
+	BuildArgs             []interface{} `json:"buildargs"`
+	Labels                []interface{} `json:"labels"`
+	CacheFrom             []interface{} `json:"cachefrom"`
+}
+
+// CheckArchive ... struct with an array of allowed values for the path
+// param of /containers/{id}/archive
+type CheckArchive struct {
+	AllowedPaths []interface{} `json:"allowed_paths"`
+}
+
+// ImagePolicy ... struct with rules for pulling, tagging and pushing images
+// and for the images referenced when creating containers and services
+type ImagePolicy struct {
+	AllowedRegistries   []string `json:"allowed_registries"`
+	AllowedRepositories []string `json:"allowed_repositories"`
+	ForbidLatest        bool     `json:"forbid_latest"`
+	RequireDigest       bool     `json:"require_digest"`
+}
+
 // RoutesConfig ... reads routes that should be available from json file
 func RoutesConfig(fptr string) RoutesAllowed {
 	// read json file
@@ -65,5 +310,141 @@ func RoutesConfig(fptr string) RoutesAllowed {
 		log.Fatal("Error unmarshalling json:", err)
 	}
 
+	if routes.Callers != nil && routes.Callers.CacheTTL != "" {
+		if _, err := time.ParseDuration(routes.Callers.CacheTTL); err != nil {
+			log.Fatal("Error parsing cache_ttl:", err)
+		}
+	}
+
+	if _, err := ParseSources(routes.AllowedSources); err != nil {
+		log.Fatal(err)
+	}
+
+	if routes.APIVersion != nil {
+		if err := routes.APIVersion.check(); err != nil {
+			log.Fatal("Error in api_version: ", err)
+		}
+	}
+	if routes.RateLimit != nil {
+		if err := routes.RateLimit.check(); err != nil {
+			log.Fatal("Error in rate_limit: ", err)
+		}
+	}
+	for name, p := range routes.Profiles {
+		if p.RateLimit != nil {
+			if err := p.RateLimit.check(); err != nil {
+				log.Fatalf("Profile %s: %v", name, err)
+			}
+		}
+	}
+
+	checkRoutes(routes.Routes)
+	for _, p := range routes.Profiles {
+		checkRoutes(p.Routes)
+	}
+
+	if err := routes.resolveProfiles(); err != nil {
+		log.Fatal(err)
+	}
+
 	return routes
 }
+
+// Tokens ... array of tokens clients can authenticate with
+type Tokens struct {
+	Tokens []Token `json:"tokens"`
+}
+
+// Token ... name of a token and the hex encoded sha256 hash of it
+type Token struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// TokensConfig ... reads hashed tokens from json file
+func TokensConfig(fptr string) Tokens {
+	data, err := ioutil.ReadFile(fptr)
+	if err != nil {
+		log.Fatal("Error reading file:", err)
+	}
+
+	var tokens Tokens
+	err = json.Unmarshal(data, &tokens)
+	if err != nil {
+		log.Fatal("Error unmarshalling json:", err)
+	}
+
+	return tokens
+}
+
+// checkRoutes ... exits if routes are not configured well
+func checkRoutes(routes []Route) {
+	for _, r := range routes {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			log.Fatalf("Route %s %s: invalid pattern: %v", r.Method, r.Pattern, err)
+		}
+		if _, err := ParseSources(r.AllowedSources); err != nil {
+			log.Fatalf("Route %s %s: %v", r.Method, r.Pattern, err)
+		}
+		if r.StreamLimits != nil {
+			if err := r.StreamLimits.check(); err != nil {
+				log.Fatalf("Route %s %s: %v", r.Method, r.Pattern, err)
+			}
+		}
+		if r.APIVersion != nil {
+			if err := r.APIVersion.check(); err != nil {
+				log.Fatalf("Route %s %s: %v", r.Method, r.Pattern, err)
+			}
+		}
+		if r.RateLimit != nil {
+			if err := r.RateLimit.check(); err != nil {
+				log.Fatalf("Route %s %s: %v", r.Method, r.Pattern, err)
+			}
+		}
+		if r.Concurrency != nil {
+			if err := r.Concurrency.check(); err != nil {
+				log.Fatalf("Route %s %s: %v", r.Method, r.Pattern, err)
+			}
+		}
+		if r.MaxBodySize < 0 {
+			log.Fatalf("Route %s %s: max_body_size must not be negative", r.Method, r.Pattern)
+		}
+		for _, c := range r.CheckParam {
+			if c.Encoding != "" && c.Encoding != EncodingJSON {
+				log.Fatalf("Unknown encoding '%s' for param %s", c.Encoding, c.Param)
+			}
+		}
+	}
+}
+
+// MustParseSources ... like ParseSources, but panics if a source is invalid, it is meant for
+// sources that were checked when the config was loaded
+func MustParseSources(sources []string) []*net.IPNet {
+	nets, err := ParseSources(sources)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// ParseSources ... parses allowed sources given as CIDRs or single IPs
+func ParseSources(sources []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, src := range sources {
+		if ip := net.ParseIP(src); ip != nil {
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(src)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid allowed source '%s'", src)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,30 @@
+package config
+
+import "testing"
+
+func TestStreamLimitsCheck(t *testing.T) {
+	tests := []struct {
+		limits StreamLimits
+		valid  bool
+	}{
+		{StreamLimits{}, true},
+		{StreamLimits{IdleTimeout: "10m", MaxDuration: "1h", MaxBytesIn: 1024}, true},
+		{StreamLimits{IdleTimeout: "1s"}, true},
+		{StreamLimits{IdleTimeout: "ten minutes"}, false},
+		{StreamLimits{IdleTimeout: "0s"}, false},
+		{StreamLimits{IdleTimeout: "-1m"}, false},
+		{StreamLimits{IdleTimeout: "5ns"}, false},
+		{StreamLimits{MaxDuration: "500ms"}, false},
+		{StreamLimits{MaxBytesOut: -1}, false},
+	}
+
+	for _, test := range tests {
+		err := test.limits.check()
+		if test.valid && err != nil {
+			t.Errorf("Stream limits %+v were rejected: %v", test.limits, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Stream limits %+v were accepted", test.limits)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Profile ... named array of routes that is used for the clients mapped to
+// it in identities, the routes of the profiles it inherits from are appended
+type Profile struct {
+	Routes    []Route    `json:"routes_allowed"`
+	Inherits  []string   `json:"inherits"`
+	RateLimit *RateLimit `json:"rate_limit"`
+}
+
+// Identity ... struct to map clients to a profile, all fields that
+// are set have to match the client
+type Identity struct {
+	Profile    string  `json:"profile"`
+	CommonName string  `json:"cert_cn"`
+	SAN        string  `json:"cert_san"`
+	PeerUID    *uint32 `json:"peer_uid"`
+	PeerGID    *uint32 `json:"peer_gid"`
+	Token      string  `json:"token"`
+	SourceCIDR string  `json:"source_cidr"`
+
+	CallerService string            `json:"caller_service"`
+	CallerStack   string            `json:"caller_stack"`
+	CallerLabels  map[string]string `json:"caller_labels"`
+}
+
+// patterns ... the regexes of an identity that are set
+func (id Identity) patterns() []string {
+	var patterns []string
+	for _, p := range []string{id.CommonName, id.SAN, id.CallerService, id.CallerStack} {
+		if p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	for _, p := range id.CallerLabels {
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// resolveProfiles ... checks the references to profiles and appends the
+// routes of inherited profiles to the routes of each profile
+func (r *RoutesAllowed) resolveProfiles() error {
+	resolved := map[string]Profile{}
+
+	var resolve func(name string, seen []string) ([]Route, error)
+	resolve = func(name string, seen []string) ([]Route, error) {
+		for _, s := range seen {
+			if s == name {
+				return nil, fmt.Errorf("Profile '%s' inherits from itself", name)
+			}
+		}
+		p, ok := r.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown profile '%s'", name)
+		}
+
+		routes := append([]Route(nil), p.Routes...)
+		for _, parent := range p.Inherits {
+			inherited, err := resolve(parent, append(seen, name))
+			if err != nil {
+				return nil, err
+			}
+			routes = append(routes, inherited...)
+		}
+		return routes, nil
+	}
+
+	for name, p := range r.Profiles {
+		routes, err := resolve(name, nil)
+		if err != nil {
+			return err
+		}
+		resolved[name] = Profile{Routes: routes, Inherits: p.Inherits, RateLimit: p.RateLimit}
+	}
+	r.Profiles = resolved
+
+	if _, ok := r.Profiles[r.DefaultProfile]; r.DefaultProfile != "" && !ok {
+		return fmt.Errorf("Default profile '%s' is unknown", r.DefaultProfile)
+	}
+
+	for _, id := range r.Identities {
+		if _, ok := r.Profiles[id.Profile]; !ok {
+			return fmt.Errorf("Identity refers to unknown profile '%s'", id.Profile)
+		}
+		for _, pattern := range id.patterns() {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("Identity for profile '%s': invalid pattern: %v", id.Profile, err)
+			}
+		}
+		if id.SourceCIDR != "" {
+			if _, err := ParseSources([]string{id.SourceCIDR}); err != nil {
+				return fmt.Errorf("Identity for profile '%s': %v", id.Profile, err)
+			}
+		}
+		if id.CommonName == "" && id.SAN == "" && id.PeerUID == nil && id.PeerGID == nil && id.Token == "" &&
+			id.SourceCIDR == "" && id.CallerService == "" && id.CallerStack == "" && len(id.CallerLabels) == 0 {
+			return fmt.Errorf("Identity for profile '%s' does not match anything", id.Profile)
+		}
+	}
+
+	return nil
+}
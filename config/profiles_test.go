@@ -0,0 +1,62 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestResolveProfiles(t *testing.T) {
+	r := RoutesAllowed{
+		Profiles: map[string]Profile{
+			"base":  {Routes: []Route{{Method: "GET", Pattern: "^/containers/json$"}}},
+			"build": {Routes: []Route{{Method: "POST", Pattern: "^/build$"}}, Inherits: []string{"base"}},
+			"admin": {Routes: []Route{{Method: "*", Pattern: "^/"}}, Inherits: []string{"build"}},
+		},
+		DefaultProfile: "base",
+	}
+
+	if err := r.resolveProfiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := r.Profiles["admin"].Routes
+	if len(admin) != 3 || admin[0].Pattern != "^/" || admin[1].Pattern != "^/build$" || admin[2].Pattern != "^/containers/json$" {
+		t.Errorf("Routes of admin were resolved incorrectly: %v", admin)
+	}
+	if len(r.Profiles["base"].Routes) != 1 {
+		t.Errorf("Routes of base were modified: %v", r.Profiles["base"].Routes)
+	}
+
+	r = RoutesAllowed{
+		Profiles: map[string]Profile{
+			"a": {Inherits: []string{"b"}},
+			"b": {Inherits: []string{"a"}},
+		},
+	}
+	if err := r.resolveProfiles(); err == nil {
+		t.Errorf("Cyclic inheritance should be rejected")
+	}
+
+	r = RoutesAllowed{
+		Profiles:   map[string]Profile{"a": {}},
+		Identities: []Identity{{Profile: "a", SourceCIDR: "10.0.0.0/33"}},
+	}
+	if err := r.resolveProfiles(); err == nil {
+		t.Errorf("Invalid source_cidr should be rejected")
+	}
+
+	for _, id := range []Identity{
+		{Profile: "a", CommonName: "^(jenkins"},
+		{Profile: "a", SAN: "[a-"},
+		{Profile: "a", CallerService: "*"},
+		{Profile: "a", CallerStack: "(?x"},
+		{Profile: "a", CallerLabels: map[string]string{"team": "a)"}},
+	} {
+		r = RoutesAllowed{
+			Profiles:   map[string]Profile{"a": {}},
+			Identities: []Identity{id},
+		}
+		if err := r.resolveProfiles(); err == nil {
+			t.Errorf("Invalid pattern of identity %+v should be rejected", id)
+		}
+	}
+}
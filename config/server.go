@@ -0,0 +1,118 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// ServerConfig ... top level config with the listeners to serve, all listeners
+// share the metrics served on metrics_address
+type ServerConfig struct {
+	Listeners      []Listener `json:"listeners"`
+	MetricsAddress string     `json:"metrics_address"`
+}
+
+// Listener ... address to listen on with its own routes file (or a profile in it),
+// upstream docker socket and client authentication
+type Listener struct {
+	Name        string       `json:"name"`
+	Address     string       `json:"address"`
+	SocketMode  string       `json:"socket_mode"`
+	Routes      string       `json:"routes"`
+	Profile     string       `json:"profile"`
+	Upstream    string       `json:"upstream"`
+	UpstreamTLS *UpstreamTLS `json:"upstream_tls"`
+	Tokens      string       `json:"tokens"`
+	TLS         *ListenerTLS `json:"tls"`
+}
+
+// ListenerTLS ... server certificate of a listener and the CA client
+// certificates have to be signed by
+type ListenerTLS struct {
+	CACert string `json:"ca_cert"`
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+}
+
+// UpstreamTLS ... TLS for a tcp upstream, like for the docker client the server
+// certificate is only verified with verify set and the client certificate is optional
+type UpstreamTLS struct {
+	Verify bool   `json:"verify"`
+	CACert string `json:"ca_cert"`
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+}
+
+// ServerConfigFile ... reads listeners from json file
+func ServerConfigFile(fptr string) ServerConfig {
+	data, err := ioutil.ReadFile(fptr)
+	if err != nil {
+		log.Fatal("Error reading file:", err)
+	}
+
+	var server ServerConfig
+	err = json.Unmarshal(data, &server)
+	if err != nil {
+		log.Fatal("Error unmarshalling json:", err)
+	}
+
+	if err := server.check(); err != nil {
+		log.Fatal(err)
+	}
+
+	return server
+}
+
+// check ... error if a listener is not configured well, sets the defaults
+// of the listeners
+func (s *ServerConfig) check() error {
+	if len(s.Listeners) == 0 {
+		return fmt.Errorf("No listeners configured")
+	}
+	names := map[string]bool{}
+	for i, l := range s.Listeners {
+		if l.Name == "" {
+			l.Name = l.Address
+		}
+		if names[l.Name] {
+			return fmt.Errorf("Listener name '%s' is not unique", l.Name)
+		}
+		names[l.Name] = true
+
+		if !strings.HasPrefix(l.Address, "tcp://") && !strings.HasPrefix(l.Address, "unix://") && !strings.HasPrefix(l.Address, "fd://") {
+			return fmt.Errorf("Listener '%s' has invalid address '%s'", l.Name, l.Address)
+		}
+		if l.Routes == "" {
+			return fmt.Errorf("Listener '%s' has no routes file", l.Name)
+		}
+		if l.Upstream == "" {
+			l.Upstream = "unix:///var/run/docker.sock"
+		}
+		if l.SocketMode == "" {
+			l.SocketMode = "0660"
+		}
+		if _, err := strconv.ParseUint(l.SocketMode, 8, 32); err != nil {
+			return fmt.Errorf("Listener '%s' has invalid socket_mode '%s'", l.Name, l.SocketMode)
+		}
+		s.Listeners[i] = l
+	}
+	return nil
+}
+
+// ForProfile ... returns a copy of the routes config in which every client gets
+// the named profile, its routes are routes_allowed as well
+func (r RoutesAllowed) ForProfile(name string) (RoutesAllowed, error) {
+	p, ok := r.Profiles[name]
+	if !ok {
+		return r, fmt.Errorf("Unknown profile '%s'", name)
+	}
+
+	r.Routes = p.Routes
+	r.Identities = nil
+	r.DefaultProfile = name
+	return r, nil
+}
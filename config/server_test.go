@@ -0,0 +1,122 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestServerConfigFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "server-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString(`{"listeners": [
+		{"name": "ci", "address": "tcp://0.0.0.0:2375", "routes": "routes_ci.json", "upstream": "tcp://docker:2375"},
+		{"address": "unix:///run/dockerguard.sock", "routes": "routes.json", "socket_mode": "0600"}
+	]}`)
+	_ = f.Close()
+
+	server := ServerConfigFile(f.Name())
+	if len(server.Listeners) != 2 {
+		t.Fatalf("Expected 2 listeners, got %d", len(server.Listeners))
+	}
+	ci, local := server.Listeners[0], server.Listeners[1]
+	if ci.Name != "ci" || ci.Upstream != "tcp://docker:2375" || ci.SocketMode != "0660" {
+		t.Errorf("Listener ci was read incorrectly: %+v", ci)
+	}
+	if local.Name != "unix:///run/dockerguard.sock" || local.Upstream != "unix:///var/run/docker.sock" || local.SocketMode != "0600" {
+		t.Errorf("Defaults of the unnamed listener are wrong: %+v", local)
+	}
+}
+
+func TestServerConfigCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		listeners []Listener
+		valid     bool
+	}{
+		{"no listeners", nil, false},
+		{"tcp", []Listener{{Address: "tcp://127.0.0.1:2375", Routes: "routes.json"}}, true},
+		{"unix", []Listener{{Address: "unix:///run/dockerguard.sock", Routes: "routes.json"}}, true},
+		{"fd", []Listener{{Address: "fd://3", Routes: "routes.json"}}, true},
+		{"address without scheme", []Listener{{Address: "127.0.0.1:2375", Routes: "routes.json"}}, false},
+		{"unknown scheme", []Listener{{Address: "udp://127.0.0.1:2375", Routes: "routes.json"}}, false},
+		{"empty address", []Listener{{Routes: "routes.json"}}, false},
+		{"no routes", []Listener{{Address: "tcp://127.0.0.1:2375"}}, false},
+		{"unique names", []Listener{
+			{Name: "a", Address: "tcp://127.0.0.1:2375", Routes: "routes.json"},
+			{Name: "b", Address: "tcp://127.0.0.1:2375", Routes: "routes.json"},
+		}, true},
+		{"duplicate names", []Listener{
+			{Name: "a", Address: "tcp://127.0.0.1:2375", Routes: "routes.json"},
+			{Name: "a", Address: "tcp://127.0.0.1:2376", Routes: "routes.json"},
+		}, false},
+		{"duplicate defaulted names", []Listener{
+			{Address: "tcp://127.0.0.1:2375", Routes: "routes.json"},
+			{Address: "tcp://127.0.0.1:2375", Routes: "routes_ci.json"},
+		}, false},
+		{"name equal to a defaulted name", []Listener{
+			{Address: "tcp://127.0.0.1:2375", Routes: "routes.json"},
+			{Name: "tcp://127.0.0.1:2375", Address: "unix:///run/dockerguard.sock", Routes: "routes.json"},
+		}, false},
+		{"socket mode", []Listener{{Address: "unix:///run/dockerguard.sock", Routes: "routes.json", SocketMode: "600"}}, true},
+		{"socket mode not octal", []Listener{{Address: "unix:///run/dockerguard.sock", Routes: "routes.json", SocketMode: "0689"}}, false},
+		{"socket mode not a number", []Listener{{Address: "unix:///run/dockerguard.sock", Routes: "routes.json", SocketMode: "rw-rw----"}}, false},
+		{"negative socket mode", []Listener{{Address: "unix:///run/dockerguard.sock", Routes: "routes.json", SocketMode: "-600"}}, false},
+	}
+
+	for _, test := range tests {
+		s := ServerConfig{Listeners: test.listeners}
+		err := s.check()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: config should be rejected", test.name)
+		}
+	}
+
+	s := ServerConfig{Listeners: []Listener{{Address: "unix:///run/dockerguard.sock", Routes: "routes.json"}}}
+	if err := s.check(); err != nil {
+		t.Fatal(err)
+	}
+	if l := s.Listeners[0]; l.Name != l.Address || l.SocketMode != "0660" || l.Upstream != "unix:///var/run/docker.sock" {
+		t.Errorf("Defaults were not set: %+v", l)
+	}
+}
+
+func TestForProfile(t *testing.T) {
+	uid := uint32(1000)
+	r := RoutesAllowed{
+		Routes: []Route{{Method: "GET", Pattern: "^/_ping$"}},
+		Profiles: map[string]Profile{
+			"ci":    {Routes: []Route{{Method: "POST", Pattern: "^/build$"}}},
+			"admin": {Routes: []Route{{Method: "*", Pattern: "^/"}}},
+		},
+		Identities:     []Identity{{Profile: "admin", PeerUID: &uid}},
+		DefaultProfile: "admin",
+	}
+
+	ci, err := r.ForProfile("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ci.Routes) != 1 || ci.Routes[0].Pattern != "^/build$" {
+		t.Errorf("Routes of the profile were not selected: %v", ci.Routes)
+	}
+	if ci.Identities != nil {
+		t.Errorf("Identities were not dropped: %v", ci.Identities)
+	}
+	if ci.DefaultProfile != "ci" {
+		t.Errorf("Default profile should be ci, got '%s'", ci.DefaultProfile)
+	}
+	if len(r.Routes) != 1 || r.Routes[0].Pattern != "^/_ping$" || len(r.Identities) != 1 || r.DefaultProfile != "admin" {
+		t.Errorf("Original config was modified: %+v", r)
+	}
+
+	if _, err := r.ForProfile("unknown"); err == nil {
+		t.Errorf("Unknown profile should be rejected")
+	}
+}
@@ -1,21 +1,26 @@
 package dockerguard
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"net"
 	"net/http"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/micoud/dockerguard/config"
 	"github.com/micoud/dockerguard/socketproxy"
 )
 
 var (
-	versionRegex = regexp.MustCompile(`^/v\d\.\d+\b`)
+	versionRegex = regexp.MustCompile(`^/v(\d+\.\d+)(?:/|$)`)
+
+	// routes that are always allowed
+	defaultGetRegex  = regexp.MustCompile(`^/(_ping|version|info)$`)
+	defaultHeadRegex = regexp.MustCompile(`^/_ping$`)
 )
 
 // RulesDirector ... struct that contains a http client additional fields needed
@@ -24,6 +29,17 @@ type RulesDirector struct {
 	Client        *http.Client
 	RoutesAllowed *config.RoutesAllowed
 	Debug         bool
+	// name of the proxy the metrics of the director are published with
+	Name string
+
+	callersOnce sync.Once
+	callers     *callerResolver
+
+	routesOnce sync.Once
+	indexes    map[string]*routeIndex
+	limiter    *rateLimiter
+	sources    []*net.IPNet
+	identities []indexedIdentity
 }
 
 func writeError(w http.ResponseWriter, msg string, code int) {
@@ -37,18 +53,6 @@ func writeError(w http.ResponseWriter, msg string, code int) {
 // Direct ... fn to handle incoming requests, it forwards allowed requests to upstream
 // or returns an error if the request is not allowed
 func (r *RulesDirector) Direct(l socketproxy.Logger, req *http.Request, upstream http.Handler) http.Handler {
-	var match = func(method string, pattern string) bool {
-		if method != "*" && method != req.Method {
-			return false
-		}
-		path := req.URL.Path
-		if versionRegex.MatchString(path) {
-			path = versionRegex.ReplaceAllString(path, "")
-		}
-		re := regexp.MustCompile(pattern)
-		return re.MatchString(path)
-	}
-
 	var errorHandler = func(msg string, code int) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			l.Printf("Handler returned error %q", msg)
@@ -57,29 +61,158 @@ func (r *RulesDirector) Direct(l socketproxy.Logger, req *http.Request, upstream
 		})
 	}
 
+	// routes are matched against the path that is forwarded, which is encoded again from
+	// the canonical path instead of passing on how the client encoded it
+	path, err := canonicalPath(req.URL)
+	if err != nil {
+		return errorHandler(err.Error(), http.StatusBadRequest)
+	}
+	req.URL.Path, req.URL.RawPath = path, ""
+
+	// routes are matched without the version
+	var version string
+	version, path = splitAPIVersion(path)
+
+	var match = func(method string, re *regexp.Regexp) bool {
+		if method != "*" && method != req.Method {
+			return false
+		}
+		return re.MatchString(path)
+	}
+
+	// check the source of the request before anything else
+	c := r.callerFromRequest(l, req)
+	if !c.fromSources(r.globalSources()) {
+		return errorHandler("Source "+c.source()+" not allowed", http.StatusForbidden)
+	}
+
+	// rate limit all requests of the caller
+	if h := checkRateLimit(l, r.globalLimiter(), c, "proxy"); h != nil {
+		return h
+	}
+
+	// clients call the default routes without version to negotiate one
+	isDefault := match(`GET`, defaultGetRegex) || match(`HEAD`, defaultHeadRegex)
+
+	// check the API version against the global constraints
+	apiVersion := r.RoutesAllowed.APIVersion
+	if version != "" || !isDefault {
+		if err := checkAPIVersion(version, apiVersion); err != nil {
+			return errorHandler(err.Error(), http.StatusForbidden)
+		}
+		if apiVersion != nil && apiVersion.Pin != "" {
+			version = apiVersion.Pin
+			setAPIVersion(req, version, path)
+		}
+	}
+
 	// match default routes
-	switch {
-	case match(`GET`, `^/(_ping|version|info)$`):
-		return upstream
-	case match(`HEAD`, `^/_ping$`):
+	if isDefault {
+		if path == "/_ping" {
+			return capAPIVersion(upstream, apiVersion)
+		}
 		return upstream
 	}
 
-	// match routes defined in json files
-	for _, route := range r.RoutesAllowed.Routes {
-		if match(route.Method, route.Pattern) {
+	// match routes defined in json files, either those of the profile
+	// the client is mapped to or the default routes
+	name, _ := r.selectProfile(l, c)
+	if ix := r.routes(name); ix != nil {
+		if h := checkRateLimit(l, ix.limiter, c, "profile "+name); h != nil {
+			return h
+		}
+	}
+
+	sourceDenied := false
+	var versionDenied error
+	for _, ir := range r.routes(name).candidates(req.Method, path) {
+		route, re := ir.Route, ir.re
+
+		// replace placeholders for the calling container
+		if r.RoutesAllowed.Callers != nil {
+			var ok bool
+			if route, ok = c.expandRoute(route); !ok {
+				continue
+			}
+			if route.Pattern != ir.Pattern {
+				re = cachedRegexp(route.Pattern)
+			}
+		}
+
+		if !c.fromSources(ir.sources) {
+			if match(route.Method, re) {
+				sourceDenied = true
+			}
+			continue
+		}
+
+		if match(route.Method, re) {
+			// check the API version against the route
+			if err := checkAPIVersion(version, route.APIVersion); err != nil {
+				versionDenied = err
+				continue
+			}
+			if route.APIVersion != nil && route.APIVersion.Pin != "" {
+				setAPIVersion(req, route.APIVersion.Pin, path)
+			}
+
+			if h := checkRateLimit(l, ir.limiter, c, routeScope(name, ir.Route)); h != nil {
+				return h
+			}
+
+			handler := upstream
+
+			// limit streams like attach and exec
+			if route.StreamLimits != nil {
+				handler = withStreamLimits(handler, route.StreamLimits)
+			}
+
+			// check images against the images policy
+			if r.RoutesAllowed.Images != nil {
+				handler = r.checkImages(l, req.Method, path, handler)
+			}
+
+			// check build context
+			if route.CheckBuild != nil {
+				handler = r.checkBuild(l, handler, route.CheckBuild)
+			}
+
+			// check uploaded archives
+			if route.CheckArchive != nil {
+				handler = r.checkArchive(l, req.Method, path, handler, route.CheckArchive)
+			}
+
 			// do request checking
-			if (route.Method == "POST" && req.Header.Get("Content-Type") == "application/json" && route.CheckJSON != nil) ||
+			if (route.Method == "POST" && isJSON(req) && req.ContentLength != 0 && route.CheckJSON != nil) ||
 				(route.CheckParam != nil) ||
 				(route.AppendFilter != nil) ||
 				(route.CheckFilter != nil) {
-				return r.checkRequest(l, req, upstream, route.CheckJSON, route.CheckParam, route.AppendFilter, route.CheckFilter)
+				handler = r.checkRequest(l, req, handler, route.CheckJSON, route.CheckParam, route.AppendFilter, route.CheckFilter)
 			}
 
-			return upstream
+			// limit the body before any of the checks reads it
+			if route.MaxBodySize > 0 {
+				handler = limitBody(route.MaxBodySize, handler)
+			}
+
+			// limit concurrent requests before their bodies are inspected, the slots are
+			// held until the response or the stream is done
+			if ir.concurrent != nil || ir.concurrentPerCaller != nil {
+				handler = withConcurrencyLimits(l, handler, ir, c.limitKey(route.Concurrency.Key))
+			}
+
+			return handler
 		}
 	}
 
+	if sourceDenied {
+		return errorHandler(req.Method+" "+req.URL.Path+" Endpoint not allowed from source "+c.source(), http.StatusForbidden)
+	}
+
+	if versionDenied != nil {
+		return errorHandler(req.Method+" "+req.URL.Path+" "+versionDenied.Error(), http.StatusForbidden)
+	}
+
 	return errorHandler(req.Method+" "+req.URL.Path+" Endpoint not allowed", http.StatusForbidden)
 }
 
@@ -98,6 +231,32 @@ func (r *RulesDirector) checkRequest(l socketproxy.Logger, req *http.Request, up
 			for _, c := range checkParam {
 				if qf := q.Get(c.Param); qf != "" {
 					fmt.Printf("Param found %s\n", qf)
+					if c.Encoding == config.EncodingJSON {
+						var decoded interface{}
+						if err := json.Unmarshal([]byte(qf), &decoded); err != nil {
+							writeError(w, fmt.Sprintf("Error decoding param %s: %v", c.Param, err), http.StatusBadRequest)
+							return
+						}
+
+						val := decoded
+						if len(c.Key) > 0 {
+							m, _ := decoded.(map[string]interface{})
+							found, v := findNested(m, c.Key)
+							if !found {
+								fmt.Printf("Key '%s' not found in param %s\n", strings.Join(c.Key, "."), c.Param)
+								continue
+							}
+							val = v
+						}
+
+						if ok, v := checkValues(val, c.AllowedValues); !ok {
+							errString := fmt.Sprintf("Found forbidden value: %v for param %s", v, c.Param)
+							fmt.Println(errString)
+							writeError(w, errString, http.StatusUnauthorized)
+							return
+						}
+						continue
+					}
 					if !isAllowed(qf, c.AllowedValues) {
 						errString := fmt.Sprintf("Found forbidden value: %v for param %s", qf, c.Param)
 						fmt.Println(errString)
@@ -205,56 +364,80 @@ func (r *RulesDirector) checkRequest(l socketproxy.Logger, req *http.Request, up
 		}
 
 		// check JSON
-		if checkJSON != nil {
+		if checkJSON != nil && isJSON(req) && req.ContentLength != 0 {
 			fmt.Println("checkRequest() - JSON checking")
-			var decoded map[string]interface{}
-			if err := json.NewDecoder(req.Body).Decode(&decoded); err != nil {
-				writeError(w, err.Error(), http.StatusBadRequest)
-				return
+			keys := make([][]string, len(checkJSON))
+			for i, c := range checkJSON {
+				keys[i] = c.Key
 			}
 
-			if r.Debug {
-				fmt.Printf("%s \n", prettyPrint(decoded))
+			// the body is inspected while it is read, upstream gets the original bytes
+			var values [][]interface{}
+			err := bufferBody(req, func(body io.Reader) (err error) {
+				values, err = jsonValues(body, keys)
+				return err
+			})
+			if err != nil {
+				writeBodyError(w, err)
+				return
 			}
+			defer req.Body.Close()
 
-			for _, c := range checkJSON {
-				found, val := findNested(decoded, c.Key)
-				if found {
-					switch vt := val.(type) {
-					// if val is an array
-					case []interface{}:
-						for _, v := range vt {
-							if !isAllowed(v, c.AllowedValues) {
-								errString := fmt.Sprintf("Found forbidden value: %v for key %s", v, c.Key)
-								fmt.Println(errString)
-								writeError(w, errString, http.StatusUnauthorized)
-								return
-							}
-						}
-					// if val is a single object
-					case interface{}:
-						if !isAllowed(val, c.AllowedValues) {
-							errString := fmt.Sprintf("Found forbidden value: %v for key %s", val, c.Key)
-							fmt.Println(errString)
-							writeError(w, errString, http.StatusUnauthorized)
-							return
-						}
-					}
-				} else {
+			for i, c := range checkJSON {
+				if len(values[i]) == 0 {
 					// TODO: this should trigger notice, that routes*.json is not configured well
 					fmt.Printf("Key '%s' not found\n", strings.Join(c.Key, "."))
+					continue
+				}
+				// keys given more than once are all checked, docker might use any of them
+				for _, val := range values[i] {
+					if r.Debug {
+						fmt.Printf("%s: %s\n", strings.Join(c.Key, "."), prettyPrint(val))
+					}
+					if ok, v := checkValues(val, c.AllowedValues); !ok {
+						errString := fmt.Sprintf("Found forbidden value: %v for key %s", v, c.Key)
+						fmt.Println(errString)
+						writeError(w, errString, http.StatusUnauthorized)
+						return
+					}
 				}
 			}
+		}
+
+		upstream.ServeHTTP(w, req)
+	})
+}
 
-			encoded, err := json.Marshal(decoded)
+// withStreamLimits ... passes the stream limits of a route on to the proxy
+func withStreamLimits(upstream http.Handler, limits *config.StreamLimits) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstream.ServeHTTP(w, socketproxy.WithStreamLimits(req, socketproxy.StreamLimits{
+			IdleTimeout: limits.Idle(),
+			MaxDuration: limits.Duration(),
+			MaxBytesIn:  limits.MaxBytesIn,
+			MaxBytesOut: limits.MaxBytesOut,
+		}))
+	})
+}
+
+// withConcurrencyLimits ... takes the concurrency slots of a route until upstream is done, the
+// slot of the caller is taken first so that waiting for it does not block a slot of the route
+func withConcurrencyLimits(l socketproxy.Logger, upstream http.Handler, ir indexedRoute, key string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, limit := range []struct {
+			limiter *socketproxy.ConcurrencyLimiter
+			key     string
+		}{{ir.concurrentPerCaller, key}, {ir.concurrent, ""}} {
+			if limit.limiter == nil {
+				continue
+			}
+			release, err := limit.limiter.Acquire(req.Context(), limit.key)
 			if err != nil {
-				writeError(w, err.Error(), http.StatusBadRequest)
+				l.Printf("Concurrency limit of the route %s %s reached: %v", ir.Method, ir.Pattern, err)
+				writeError(w, "Too many concurrent requests", http.StatusTooManyRequests)
 				return
 			}
-
-			// reset it so that upstream can read it again
-			req.ContentLength = int64(len(encoded))
-			req.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+			defer release()
 		}
 
 		upstream.ServeHTTP(w, req)
@@ -267,39 +450,53 @@ func prettyPrint(i interface{}) string {
 	return string(s)
 }
 
-// aux function to find nested key 'key' in map
+// aux function to find nested key 'key' in map, every key has to be found
+// in the map of the key before it
 func findNested(m map[string]interface{}, keys []string) (bool, interface{}) {
-	// fmt.Printf("keys: %s, len(keys) %d\n", keys, len(keys))
-	// already reached the last level
-	if keys != nil {
-		for k, v := range m {
-			if k == keys[0] && len(keys) == 1 {
-				// fmt.Printf("%s %s %v\n", keys[0], k, v)
-				return true, v
-			}
-		}
+	if len(keys) == 0 {
+		return false, nil
+	}
 
-		for _, v := range m {
-			nm, ok := v.(map[string]interface{})
-			if ok && len(keys) > 1 {
-				found, val := findNested(nm, keys[1:])
-				if found {
-					return found, val
-				}
+	v, ok := m[keys[0]]
+	if !ok {
+		return false, nil
+	}
+	if len(keys) == 1 {
+		return true, v
+	}
+
+	nm, ok := v.(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+	return findNested(nm, keys[1:])
+}
+
+// aux function to check a value found in json / param, if it is an array
+// every element is checked, returns the first value that is not allowed
+func checkValues(val interface{}, allowedValues []interface{}) (bool, interface{}) {
+	switch vt := val.(type) {
+	// if val is an array
+	case []interface{}:
+		for _, v := range vt {
+			if !isAllowed(v, allowedValues) {
+				return false, v
 			}
 		}
+	// if val is a single object
+	case interface{}:
+		if !isAllowed(val, allowedValues) {
+			return false, val
+		}
 	}
-
-	// not found at all
-	return false, nil
+	return true, nil
 }
 
 // aux function to match allowed_values with values in json / param
 func isAllowed(value interface{}, allowedValues []interface{}) bool {
 	var matchString = func(v string, a string) bool {
 		fmt.Printf("Check allowed string: '%s' against '%s'\n", v, a)
-		re := regexp.MustCompile(a)
-		return re.MatchString(v)
+		return cachedRegexp(a).MatchString(v)
 	}
 
 	var matchFloat = func(v float64, a float64) bool {
@@ -337,8 +534,7 @@ func isAllowed(value interface{}, allowedValues []interface{}) bool {
 						case string:
 							if va, ok := va.(string); ok {
 								fmt.Printf("Check allowed string: '%s' against '%s'\n", vt, va)
-								re := regexp.MustCompile(va)
-								if !re.MatchString(vt) {
+								if !cachedRegexp(va).MatchString(vt) {
 									return false
 								}
 							}
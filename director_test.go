@@ -1,12 +1,22 @@
 package dockerguard
 
 import (
+	"archive/tar"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/micoud/dockerguard/config"
 )
 
 func TestFindJSONKey(t *testing.T) {
@@ -62,6 +72,47 @@ func testFindNested(t *testing.T, json map[string]interface{}, keys []string, ex
 	}
 }
 
+func TestKeyPaths(t *testing.T) {
+	r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{
+		Routes: []config.Route{
+			{Method: "POST", Pattern: "^/containers/create$", CheckJSON: []config.CheckJSON{
+				{Key: []string{"HostConfig", "Privileged"}, AllowedValues: []interface{}{false}},
+			}},
+			{Method: "GET", Pattern: "^/containers/json$", CheckParam: []config.CheckParam{
+				{Param: "spec", Encoding: config.EncodingJSON, Key: []string{"Labels", "team"}, AllowedValues: []interface{}{`^ci$`}},
+			}},
+		},
+	}}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	tests := []struct {
+		method   string
+		path     string
+		body     string
+		expected int
+	}{
+		{"POST", "/containers/create", `{"HostConfig":{"Privileged":false}}`, http.StatusOK},
+		{"POST", "/containers/create", `{"HostConfig":{"Privileged":true}}`, http.StatusUnauthorized},
+		// keys are looked up along their path only, a decoy elsewhere does not satisfy them
+		{"POST", "/containers/create", `{"Decoy":{"Privileged":false},"HostConfig":{"Privileged":true}}`, http.StatusUnauthorized},
+		{"GET", "/containers/json?spec=" + url.QueryEscape(`{"Labels":{"team":"ci"}}`), "", http.StatusOK},
+		{"GET", "/containers/json?spec=" + url.QueryEscape(`{"Labels":{"team":"ops"}}`), "", http.StatusUnauthorized},
+		{"GET", "/containers/json?spec=" + url.QueryEscape(`{"Decoy":{"team":"ci"},"Labels":{"team":"ops"}}`), "", http.StatusUnauthorized},
+	}
+
+	// the order of keys in decoded maps is random, a decoy would be found sometimes only
+	for i := 0; i < 20; i++ {
+		for _, test := range tests {
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			rec := httptest.NewRecorder()
+			r.Direct(log.New(ioutil.Discard, "", 0), req, upstream).ServeHTTP(rec, req)
+			if rec.Code != test.expected {
+				t.Fatalf("Status for %s %s with %s was incorrect, got %d, want %d", test.method, test.path, test.body, rec.Code, test.expected)
+			}
+		}
+	}
+}
+
 func TestIsAllowed(t *testing.T) {
 	value := []byte(`{"Source": "/mnt/scratch/", "Target": 10, "ReadOnly": true, "Labels": {"com.example.something": "something-value"}}`)
 	allowed := []byte(`[{"Source": "^/mnt/scratch", "Target": 10, "ReadOnly": true}]`)
@@ -83,3 +134,135 @@ func TestIsAllowed(t *testing.T) {
 		t.Errorf("Value %v not matching %v", decodedValue, decodedAllowed)
 	}
 }
+
+func TestCheckParamJSON(t *testing.T) {
+	r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{}}
+	checkParam := []config.CheckParam{
+		{Param: "buildargs", Encoding: config.EncodingJSON, Key: []string{"HTTP_PROXY"}, AllowedValues: []interface{}{"^http://proxy:3128$"}},
+		{Param: "cachefrom", Encoding: config.EncodingJSON, AllowedValues: []interface{}{"^registry\\.example\\.com/"}},
+	}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	handler := r.checkRequest(log.New(ioutil.Discard, "", 0), nil, upstream, nil, checkParam, nil, nil)
+
+	tests := []struct {
+		query    string
+		expected int
+	}{
+		{`buildargs={"HTTP_PROXY":"http://proxy:3128"}`, http.StatusOK},
+		{`buildargs={"NO_PROXY":"*"}`, http.StatusOK},
+		{`buildargs={"HTTP_PROXY":"http://evil:3128"}`, http.StatusUnauthorized},
+		{`cachefrom=["registry.example.com/app"]`, http.StatusOK},
+		{`cachefrom=["registry.example.com/app","evil.com/app"]`, http.StatusUnauthorized},
+		{`cachefrom=[`, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/build?"+url.PathEscape(test.query), nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.expected {
+			t.Errorf("Status for '%s' was incorrect, got %d, want %d", test.query, rec.Code, test.expected)
+		}
+	}
+}
+
+func TestAllowedSources(t *testing.T) {
+	r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{
+		AllowedSources: []string{"10.0.0.0/16", "192.0.2.1"},
+		Routes: []config.Route{
+			{Method: "POST", Pattern: "^/containers/create$", AllowedSources: []string{"10.0.1.0/24"}},
+			{Method: "GET", Pattern: "^/containers/json$"},
+		},
+	}}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	tests := []struct {
+		method     string
+		path       string
+		remoteAddr string
+		expected   int
+	}{
+		{"GET", "/_ping", "10.0.2.1:1234", http.StatusOK},
+		{"GET", "/_ping", "172.16.0.1:1234", http.StatusForbidden},
+		{"GET", "/_ping", "@", http.StatusForbidden},
+		{"GET", "/containers/json", "192.0.2.1:1234", http.StatusOK},
+		{"POST", "/containers/create", "10.0.1.5:1234", http.StatusOK},
+		{"POST", "/containers/create", "10.0.2.5:1234", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		req.RemoteAddr = test.remoteAddr
+		rec := httptest.NewRecorder()
+		r.Direct(log.New(ioutil.Discard, "", 0), req, upstream).ServeHTTP(rec, req)
+		if rec.Code != test.expected {
+			t.Errorf("Status for %s %s from %s was incorrect, got %d, want %d", test.method, test.path, test.remoteAddr, rec.Code, test.expected)
+		}
+	}
+
+	// sources are checked when the config is loaded, an invalid one is not silently ignored
+	r = &RulesDirector{RoutesAllowed: &config.RoutesAllowed{AllowedSources: []string{"10.0.0.0/33"}}}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Invalid source was accepted")
+		}
+	}()
+	req := httptest.NewRequest("GET", "/_ping", nil)
+	r.Direct(log.New(ioutil.Discard, "", 0), req, upstream).ServeHTTP(httptest.NewRecorder(), req)
+}
+
+// readFlag ... body that records whether it was read
+type readFlag struct {
+	read bool
+}
+
+func (f *readFlag) Read(p []byte) (int, error) {
+	f.read = true
+	return 0, io.EOF
+}
+
+func TestConcurrencyLimitBeforeChecks(t *testing.T) {
+	r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{
+		Routes: []config.Route{{
+			Method:      "POST",
+			Pattern:     "^/build$",
+			CheckBuild:  &config.CheckBuild{},
+			Concurrency: &config.Concurrency{Max: 1},
+		}},
+	}}
+
+	started, done := make(chan struct{}), make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-done
+	})
+	logger := log.New(ioutil.Discard, "", 0)
+
+	var buildContext bytes.Buffer
+	tw := tar.NewWriter(&buildContext)
+	dockerfile := []byte("FROM alpine:3.12\n")
+	_ = tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerfile))})
+	_, _ = tw.Write(dockerfile)
+	_ = tw.Close()
+
+	first := httptest.NewRequest("POST", "/build", &buildContext)
+	go r.Direct(logger, first, upstream).ServeHTTP(httptest.NewRecorder(), first)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("First build was not forwarded")
+	}
+
+	// the body of a request over the limit is not spooled by the build check
+	body := &readFlag{}
+	req := httptest.NewRequest("POST", "/build", body)
+	rec := httptest.NewRecorder()
+	r.Direct(logger, req, upstream).ServeHTTP(rec, req)
+	close(done)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Second build should be rejected with %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if body.read {
+		t.Errorf("Body of the rejected build was read")
+	}
+}
@@ -0,0 +1,187 @@
+package dockerguard
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/micoud/dockerguard/config"
+	"github.com/micoud/dockerguard/socketproxy"
+)
+
+// caller ... identity of the client that sent a request
+type caller struct {
+	CommonName string
+	SANs       []string
+	Peer       *socketproxy.PeerCred
+	Token      string
+	SourceIP   net.IP
+	Container  *containerInfo
+}
+
+// callerFromRequest ... collects what is known about the client of req
+func (r *RulesDirector) callerFromRequest(l socketproxy.Logger, req *http.Request) caller {
+	var c caller
+
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		cert := req.TLS.PeerCertificates[0]
+		c.CommonName = cert.Subject.CommonName
+		c.SANs = append(c.SANs, cert.DNSNames...)
+		c.SANs = append(c.SANs, cert.EmailAddresses...)
+		for _, ip := range cert.IPAddresses {
+			c.SANs = append(c.SANs, ip.String())
+		}
+		for _, uri := range cert.URIs {
+			c.SANs = append(c.SANs, uri.String())
+		}
+	}
+
+	if cred, ok := socketproxy.PeerCredFromContext(req.Context()); ok {
+		c.Peer = &cred
+	}
+
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		c.SourceIP = net.ParseIP(host)
+	}
+
+	if name, ok := socketproxy.TokenFromContext(req.Context()); ok {
+		c.Token = name
+	}
+
+	if r.RoutesAllowed.Callers != nil {
+		r.callersOnce.Do(func() {
+			r.callers = newCallerResolver(r.Client, r.RoutesAllowed.Callers)
+		})
+		c.Container = r.callers.lookup(l, req.RemoteAddr)
+	}
+
+	return c
+}
+
+func (c caller) String() string {
+	switch {
+	case c.Token != "":
+		return "token=" + c.Token
+	case c.CommonName != "":
+		return "cn=" + c.CommonName
+	case c.Container != nil:
+		return "container=" + c.Container.Name
+	case c.Peer != nil:
+		return fmt.Sprintf("uid=%d gid=%d pid=%d", c.Peer.UID, c.Peer.GID, c.Peer.PID)
+	case c.SourceIP != nil:
+		return "ip=" + c.SourceIP.String()
+	}
+	return "anonymous"
+}
+
+// source ... description of where the request came from
+func (c caller) source() string {
+	if c.SourceIP == nil {
+		return "without IP"
+	}
+	return c.SourceIP.String()
+}
+
+// fromSources ... true if no sources are given or the source IP is in one of them,
+// requests without source IP (e.g. via unix socket) never match
+func (c caller) fromSources(sources []*net.IPNet) bool {
+	if len(sources) == 0 {
+		return true
+	}
+	if c.SourceIP == nil {
+		return false
+	}
+
+	for _, n := range sources {
+		if n.Contains(c.SourceIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexedIdentity ... identity with its parsed source_cidr
+type indexedIdentity struct {
+	config.Identity
+	sources []*net.IPNet
+}
+
+// matches ... true if all fields that are set in id match the caller
+func (c caller) matches(id indexedIdentity) bool {
+	if id.CommonName != "" {
+		if c.CommonName == "" || !cachedRegexp(id.CommonName).MatchString(c.CommonName) {
+			return false
+		}
+	}
+
+	if id.SAN != "" {
+		re := cachedRegexp(id.SAN)
+		found := false
+		for _, san := range c.SANs {
+			if re.MatchString(san) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if id.CallerService != "" || id.CallerStack != "" || len(id.CallerLabels) > 0 {
+		if c.Container == nil {
+			return false
+		}
+		if id.CallerService != "" && !cachedRegexp(id.CallerService).MatchString(c.Container.Service) {
+			return false
+		}
+		if id.CallerStack != "" && !cachedRegexp(id.CallerStack).MatchString(c.Container.Stack) {
+			return false
+		}
+		for k, v := range id.CallerLabels {
+			label, ok := c.Container.Labels[k]
+			if !ok || !cachedRegexp(v).MatchString(label) {
+				return false
+			}
+		}
+	}
+
+	if id.Token != "" && id.Token != c.Token {
+		return false
+	}
+
+	if id.SourceCIDR != "" && !c.fromSources(id.sources) {
+		return false
+	}
+
+	if id.PeerUID != nil && (c.Peer == nil || c.Peer.UID != *id.PeerUID) {
+		return false
+	}
+	if id.PeerGID != nil && (c.Peer == nil || c.Peer.GID != *id.PeerGID) {
+		return false
+	}
+
+	return true
+}
+
+// selectProfile ... returns the name and the profile of the first identity matching the
+// caller, callers without a matching identity get the default profile or routes_allowed
+func (r *RulesDirector) selectProfile(l socketproxy.Logger, c caller) (string, config.Profile) {
+	name := r.RoutesAllowed.DefaultProfile
+	for _, id := range r.identityIndex() {
+		if c.matches(id) {
+			name = id.Profile
+			break
+		}
+	}
+
+	if name == "" {
+		if len(r.RoutesAllowed.Profiles) > 0 {
+			l.Printf("Client '%s' uses routes_allowed", c)
+		}
+		return "", config.Profile{Routes: r.RoutesAllowed.Routes}
+	}
+
+	l.Printf("Client '%s' uses profile '%s'", c, name)
+	return name, r.RoutesAllowed.Profiles[name]
+}
@@ -0,0 +1,80 @@
+//go:build linux
+// +build linux
+
+package dockerguard
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/micoud/dockerguard/config"
+	"github.com/micoud/dockerguard/socketproxy"
+)
+
+func TestPeerIdentity(t *testing.T) {
+	uid := uint32(os.Getuid())
+	r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{
+		Profiles: map[string]config.Profile{
+			"local": {Routes: []config.Route{{Method: "GET", Pattern: "^/containers/json$"}}},
+		},
+		Identities: []config.Identity{{Profile: "local", PeerUID: &uid}},
+	}}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	l := log.New(ioutil.Discard, "", 0)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.Direct(l, req, upstream).ServeHTTP(w, req)
+	}))
+	server.Config.ConnContext = socketproxy.ConnContext
+	server.Start()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "dockerguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "proxy.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go server.Config.Serve(listener)
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+
+	tests := []struct {
+		name     string
+		client   *http.Client
+		url      string
+		expected int
+	}{
+		// the uid of this process selects the profile via the unix socket
+		{"unix", unixClient, "http://docker/containers/json", http.StatusOK},
+		// TCP connections have no peer credentials
+		{"tcp", server.Client(), server.URL + "/containers/json", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		resp, err := test.client.Get(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != test.expected {
+			t.Errorf("Status via %s was incorrect, got %d, want %d", test.name, resp.StatusCode, test.expected)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package dockerguard
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/micoud/dockerguard/config"
+)
+
+func TestSelectProfile(t *testing.T) {
+	r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{
+		Profiles: map[string]config.Profile{
+			"build":  {},
+			"deploy": {},
+		},
+		Identities: []config.Identity{
+			{Profile: "build", CommonName: "^build-agent-[0-9]+$"},
+			{Profile: "deploy", SAN: "^deploy\\.example\\.com$"},
+			{Profile: "deploy", SourceCIDR: "10.0.1.0/24"},
+		},
+	}}
+
+	tests := []struct {
+		cert       *x509.Certificate
+		remoteAddr string
+		expected   string
+	}{
+		{nil, "192.0.2.1:1234", ""},
+		{nil, "10.0.1.5:1234", "deploy"},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "build-agent-1"}}, "192.0.2.1:1234", "build"},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "build-agent-x"}}, "192.0.2.1:1234", ""},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "agent"}, DNSNames: []string{"deploy.example.com"}}, "192.0.2.1:1234", "deploy"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/containers/json", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.cert != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.cert}}
+		}
+		l := log.New(ioutil.Discard, "", 0)
+		name, _ := r.selectProfile(l, r.callerFromRequest(l, req))
+		if name != test.expected {
+			t.Errorf("Profile was incorrect, got '%s', want '%s'", name, test.expected)
+		}
+	}
+}
+
+func TestDefaultProfile(t *testing.T) {
+	r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{
+		Profiles:       map[string]config.Profile{"readonly": {}},
+		DefaultProfile: "readonly",
+	}}
+
+	l := log.New(ioutil.Discard, "", 0)
+	req := httptest.NewRequest("GET", "/containers/json", nil)
+	if name, _ := r.selectProfile(l, r.callerFromRequest(l, req)); name != "readonly" {
+		t.Errorf("Profile was incorrect, got '%s', want 'readonly'", name)
+	}
+}
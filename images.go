@@ -0,0 +1,379 @@
+package dockerguard
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/micoud/dockerguard/config"
+	"github.com/micoud/dockerguard/socketproxy"
+)
+
+const (
+	defaultRegistry = "docker.io"
+	defaultTag      = "latest"
+)
+
+var (
+	imageCreateRegex     = regexp.MustCompile(`^/images/create$`)
+	imageTagRegex        = regexp.MustCompile(`^/images/(.+)/tag$`)
+	imagePushRegex       = regexp.MustCompile(`^/images/(.+)/push$`)
+	imageLoadRegex       = regexp.MustCompile(`^/images/load$`)
+	containerCreateRegex = regexp.MustCompile(`^/containers/create$`)
+	serviceCreateRegex   = regexp.MustCompile(`^/services/(create|[^/]+/update)$`)
+
+	domainRegex   = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?$`)
+	repoPathRegex = regexp.MustCompile(`^[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*)*$`)
+	tagRegex      = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegex   = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-fA-F0-9]{32,}$`)
+)
+
+// imageRef ... normalized docker image reference, e.g. 'nginx:alpine' is
+// split into 'docker.io', 'library/nginx' and 'alpine'
+type imageRef struct {
+	Domain string
+	Path   string
+	Tag    string
+	Digest string
+}
+
+// Repository ... full repository name including the registry domain
+func (i imageRef) Repository() string {
+	return i.Domain + "/" + i.Path
+}
+
+func (i imageRef) String() string {
+	s := i.Repository()
+	if i.Tag != "" {
+		s += ":" + i.Tag
+	}
+	if i.Digest != "" {
+		s += "@" + i.Digest
+	}
+	return s
+}
+
+// parseImageRef ... parses and normalizes an image reference the way the docker
+// daemon does, a missing registry defaults to docker.io and official images get
+// the 'library/' prefix
+func parseImageRef(s string) (imageRef, error) {
+	var ref imageRef
+
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+		if !digestRegex.MatchString(ref.Digest) {
+			return ref, fmt.Errorf("invalid digest in image reference %q", s)
+		}
+	}
+
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i:], "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+		if !tagRegex.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid tag in image reference %q", s)
+		}
+	}
+
+	ref.Domain = defaultRegistry
+	ref.Path = name
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			ref.Domain = first
+			ref.Path = name[i+1:]
+		}
+	}
+	if ref.Domain == "index.docker.io" {
+		ref.Domain = defaultRegistry
+	}
+	if ref.Domain == defaultRegistry && !strings.Contains(ref.Path, "/") {
+		ref.Path = "library/" + ref.Path
+	}
+
+	if !domainRegex.MatchString(ref.Domain) {
+		return ref, fmt.Errorf("invalid registry in image reference %q", s)
+	}
+	if !repoPathRegex.MatchString(ref.Path) {
+		return ref, fmt.Errorf("invalid repository name in image reference %q", s)
+	}
+
+	return ref, nil
+}
+
+// checkImages ... wraps upstream with the checks of the images policy if the request
+// pulls, tags or pushes an image or creates a container or service from an image
+func (r *RulesDirector) checkImages(l socketproxy.Logger, method string, path string, upstream http.Handler) http.Handler {
+	policy := r.RoutesAllowed.Images
+	if method != "POST" {
+		return upstream
+	}
+
+	var deny = func(w http.ResponseWriter, msg string) {
+		l.Printf("Image policy: %s", msg)
+		writeError(w, msg, http.StatusForbidden)
+	}
+
+	switch {
+	case imageCreateRegex.MatchString(path):
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			q := req.URL.Query()
+			// the daemon pulls whenever fromImage is set, even if fromSrc is set as well
+			if fromImage := q.Get("fromImage"); fromImage != "" || q.Get("fromSrc") == "" {
+				if err := checkImagePull(policy, fromImage, q.Get("tag")); err != nil {
+					deny(w, err.Error())
+					return
+				}
+			} else if err := checkImageTarget(policy, q.Get("repo"), q.Get("tag")); err != nil {
+				// importing an image creates the repository given in 'repo'
+				deny(w, err.Error())
+				return
+			}
+			upstream.ServeHTTP(w, req)
+		})
+	case imageTagRegex.MatchString(path):
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			q := req.URL.Query()
+			if err := checkImageTarget(policy, q.Get("repo"), q.Get("tag")); err != nil {
+				deny(w, err.Error())
+				return
+			}
+			upstream.ServeHTTP(w, req)
+		})
+	case imagePushRegex.MatchString(path):
+		name := imagePushRegex.FindStringSubmatch(path)[1]
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if err := checkImageTarget(policy, name, req.URL.Query().Get("tag")); err != nil {
+				deny(w, err.Error())
+				return
+			}
+			upstream.ServeHTTP(w, req)
+		})
+	case imageLoadRegex.MatchString(path):
+		return checkImageLoad(policy, deny, upstream)
+	case containerCreateRegex.MatchString(path):
+		return checkImageInBody(policy, []string{"Image"}, deny, upstream)
+	case serviceCreateRegex.MatchString(path):
+		return checkImageInBody(policy, []string{"TaskTemplate", "ContainerSpec", "Image"}, deny, upstream)
+	}
+
+	return upstream
+}
+
+// checkImageInBody ... checks the image referenced under key in the posted JSON
+func checkImageInBody(policy *config.ImagePolicy, key []string, deny func(http.ResponseWriter, string), upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var values [][]interface{}
+		err := bufferBody(req, func(body io.Reader) (err error) {
+			values, err = jsonValues(body, [][]string{key})
+			return err
+		})
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		defer req.Body.Close()
+
+		if len(values[0]) == 0 {
+			deny(w, fmt.Sprintf("No image found for key %s", strings.Join(key, ".")))
+			return
+		}
+		// every occurrence is checked, docker might use any of them
+		for _, val := range values[0] {
+			image, ok := val.(string)
+			if !ok {
+				deny(w, fmt.Sprintf("No image found for key %s", strings.Join(key, ".")))
+				return
+			}
+
+			ref, err := parseImageRef(image)
+			if err != nil {
+				deny(w, err.Error())
+				return
+			}
+			if err := checkImageSource(policy, ref); err != nil {
+				deny(w, err.Error())
+				return
+			}
+			if policy.RequireDigest && ref.Digest == "" {
+				deny(w, fmt.Sprintf("Image %s is not pinned by digest", image))
+				return
+			}
+		}
+
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+// annotations of OCI image indexes the daemon takes the names of loaded images from
+var imageNameAnnotations = []string{"io.containerd.image.name", "org.opencontainers.image.ref.name"}
+
+// checkImageLoad ... checks the repo tags an image tarball posted to /images/load
+// declares in manifest.json, in the annotations of index.json for OCI layouts or in
+// repositories for the legacy format
+func checkImageLoad(policy *config.ImagePolicy, deny func(http.ResponseWriter, string), upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, size, err := spoolTar(req.Body, func(hdr *tar.Header, tr io.Reader) error {
+			var tags []string
+			switch path.Clean(hdr.Name) {
+			case "manifest.json":
+				var manifest []struct {
+					RepoTags []string
+				}
+				if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+					return tarError{fmt.Errorf("invalid manifest.json: %v", err)}
+				}
+				for _, m := range manifest {
+					tags = append(tags, m.RepoTags...)
+				}
+			case "index.json":
+				// OCI layouts name their images in annotations, the daemon tags them as
+				// any of these
+				var index struct {
+					Manifests []struct {
+						Annotations map[string]string
+					}
+				}
+				if err := json.NewDecoder(tr).Decode(&index); err != nil {
+					return tarError{fmt.Errorf("invalid index.json: %v", err)}
+				}
+				for _, m := range index.Manifests {
+					for _, key := range imageNameAnnotations {
+						if name, ok := m.Annotations[key]; ok {
+							tags = append(tags, name)
+						}
+					}
+				}
+			case "repositories":
+				var repositories map[string]map[string]string
+				if err := json.NewDecoder(tr).Decode(&repositories); err != nil {
+					return tarError{fmt.Errorf("invalid repositories: %v", err)}
+				}
+				for repo, t := range repositories {
+					for tag := range t {
+						tags = append(tags, repo+":"+tag)
+					}
+				}
+			}
+
+			for _, tag := range tags {
+				if err := checkImageTarget(policy, tag, ""); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			if _, ok := err.(tarError); ok {
+				writeBodyError(w, err)
+				return
+			}
+			deny(w, err.Error())
+			return
+		}
+		defer body.Close()
+
+		// forward the spooled tarball
+		setSpooledBody(req, body, size)
+		upstream.ServeHTTP(w, req)
+	})
+}
+
+// checkImagePull ... checks an image that is pulled via fromImage and tag
+func checkImagePull(policy *config.ImagePolicy, fromImage string, tag string) error {
+	if fromImage == "" {
+		return fmt.Errorf("No image to pull given")
+	}
+
+	ref, err := parseImageRef(fromImage)
+	if err != nil {
+		return err
+	}
+	if err := setTagOrDigest(&ref, tag); err != nil {
+		return err
+	}
+
+	return checkImageSource(policy, ref)
+}
+
+// checkImageTarget ... checks a repository and tag that an image is tagged as or pushed to
+func checkImageTarget(policy *config.ImagePolicy, repo string, tag string) error {
+	if repo == "" {
+		return fmt.Errorf("No target repository given")
+	}
+
+	ref, err := parseImageRef(repo)
+	if err != nil {
+		return err
+	}
+	if err := setTagOrDigest(&ref, tag); err != nil {
+		return err
+	}
+
+	if !matchesAny(ref.Repository(), policy.AllowedRepositories) {
+		return fmt.Errorf("Repository %s is not allowed", ref.Repository())
+	}
+	if policy.ForbidLatest && isLatest(ref) {
+		return fmt.Errorf("Tag '%s' is forbidden for %s", defaultTag, ref.Repository())
+	}
+
+	return nil
+}
+
+// checkImageSource ... checks the registry and tag an image is taken from
+func checkImageSource(policy *config.ImagePolicy, ref imageRef) error {
+	if !matchesAny(ref.Domain, policy.AllowedRegistries) {
+		return fmt.Errorf("Registry %s is not allowed", ref.Domain)
+	}
+	if policy.ForbidLatest && isLatest(ref) {
+		return fmt.Errorf("Tag '%s' is forbidden for %s", defaultTag, ref.Repository())
+	}
+
+	return nil
+}
+
+// setTagOrDigest ... applies the value of a 'tag' URL param, which may also be a digest
+func setTagOrDigest(ref *imageRef, tag string) error {
+	switch {
+	case tag == "":
+		return nil
+	case strings.Contains(tag, ":"):
+		if !digestRegex.MatchString(tag) {
+			return fmt.Errorf("invalid digest %q", tag)
+		}
+		ref.Digest = tag
+	default:
+		if !tagRegex.MatchString(tag) {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+		ref.Tag = tag
+	}
+
+	return nil
+}
+
+// isLatest ... true if a reference points to 'latest', either explicitly or because
+// it has neither a tag nor a digest
+func isLatest(ref imageRef) bool {
+	return ref.Tag == defaultTag || (ref.Tag == "" && ref.Digest == "")
+}
+
+// matchesAny ... true if the patterns are not given or value matches one of them, like
+// lists of allowed values an empty list matches nothing
+func matchesAny(value string, patterns []string) bool {
+	if patterns == nil {
+		return true
+	}
+	for _, p := range patterns {
+		if cachedRegexp(p).MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
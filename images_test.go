@@ -0,0 +1,184 @@
+package dockerguard
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/micoud/dockerguard/config"
+)
+
+func TestParseImageRef(t *testing.T) {
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		{"nginx", "docker.io/library/nginx"},
+		{"nginx:alpine", "docker.io/library/nginx:alpine"},
+		{"jenkins/jenkins:lts", "docker.io/jenkins/jenkins:lts"},
+		{"index.docker.io/library/nginx", "docker.io/library/nginx"},
+		{"localhost/dockerguard", "localhost/dockerguard"},
+		{"localhost:5000/dockerguard:1.0", "localhost:5000/dockerguard:1.0"},
+		{"registry.cta-test.zeuthen.desy.de/acs@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			"registry.cta-test.zeuthen.desy.de/acs@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+	}
+
+	for _, test := range tests {
+		ref, err := parseImageRef(test.image)
+		if err != nil {
+			t.Errorf("Parsing '%s' failed: %v", test.image, err)
+			continue
+		}
+		if ref.String() != test.expected {
+			t.Errorf("Reference was incorrect, got '%s', want '%s'", ref.String(), test.expected)
+		}
+	}
+
+	for _, image := range []string{"", "Nginx", "nginx:", "nginx@sha256:xyz", "../nginx"} {
+		if _, err := parseImageRef(image); err == nil {
+			t.Errorf("Parsing '%s' should have failed", image)
+		}
+	}
+}
+
+func TestCheckImageTarget(t *testing.T) {
+	policy := &config.ImagePolicy{
+		AllowedRepositories: []string{`^registry\.example\.com/ci/`},
+		ForbidLatest:        true,
+	}
+
+	if err := checkImageTarget(policy, "registry.example.com/ci/app", "1.0"); err != nil {
+		t.Errorf("Target should be allowed: %v", err)
+	}
+	if err := checkImageTarget(policy, "registry.example.com/ci/app", ""); err == nil {
+		t.Errorf("Implicit 'latest' should be forbidden")
+	}
+	if err := checkImageTarget(policy, "registry.example.com/ci/app", "latest"); err == nil {
+		t.Errorf("Explicit 'latest' should be forbidden")
+	}
+	if err := checkImageTarget(policy, "docker.io/ci/app", "1.0"); err == nil {
+		t.Errorf("Repository outside of allowed repositories should be forbidden")
+	}
+}
+
+func TestImagePolicyLists(t *testing.T) {
+	ref, err := parseImageRef("registry.example.com/ci/app:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// like other lists of allowed values an empty list allows nothing
+	tests := []struct {
+		policy  string
+		allowed bool
+	}{
+		{`{}`, true},
+		{`{"allowed_registries": null}`, true},
+		{`{"allowed_registries": []}`, false},
+		{`{"allowed_registries": ["^registry\\.example\\.com$"]}`, true},
+		{`{"allowed_registries": ["^docker\\.io$"]}`, false},
+	}
+
+	for _, test := range tests {
+		var policy config.ImagePolicy
+		if err := json.Unmarshal([]byte(test.policy), &policy); err != nil {
+			t.Fatal(err)
+		}
+		err := checkImageSource(&policy, ref)
+		if test.allowed && err != nil {
+			t.Errorf("Image should be allowed by %s: %v", test.policy, err)
+		}
+		if !test.allowed && err == nil {
+			t.Errorf("Image should be forbidden by %s", test.policy)
+		}
+	}
+}
+
+func TestCheckImageCreate(t *testing.T) {
+	r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{Images: &config.ImagePolicy{
+		AllowedRegistries:   []string{`^registry\.example\.com$`},
+		AllowedRepositories: []string{`^registry\.example\.com/ci/`},
+	}}}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	l := log.New(ioutil.Discard, "", 0)
+
+	tests := []struct {
+		query    string
+		expected int
+	}{
+		{"fromImage=registry.example.com/ci/app&tag=1.0", http.StatusOK},
+		{"fromImage=evil.example/x&tag=1.0", http.StatusForbidden},
+		{"fromSrc=-&repo=registry.example.com/ci/app&tag=1.0", http.StatusOK},
+		{"fromSrc=-&repo=evil.example/x&tag=1.0", http.StatusForbidden},
+		// the daemon pulls fromImage and ignores fromSrc
+		{"fromImage=evil.example/x&fromSrc=-&repo=registry.example.com/ci/app&tag=1.0", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/images/create?"+test.query, nil)
+		rec := httptest.NewRecorder()
+		r.checkImages(l, "POST", "/images/create", upstream).ServeHTTP(rec, req)
+		if rec.Code != test.expected {
+			t.Errorf("Status for %s was incorrect, got %d, want %d", test.query, rec.Code, test.expected)
+		}
+	}
+}
+
+// tarball ... tar archive of the files given by name and content
+func tarball(t *testing.T, files ...string) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		if err := tw.WriteHeader(&tar.Header{Name: files[i], Mode: 0644, Size: int64(len(files[i+1]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestCheckImageLoad(t *testing.T) {
+	r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{Images: &config.ImagePolicy{
+		AllowedRepositories: []string{`^registry\.example\.com/ci/`},
+	}}}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	l := log.New(ioutil.Discard, "", 0)
+
+	tests := []struct {
+		name     string
+		files    []string
+		expected int
+	}{
+		{"manifest", []string{"manifest.json", `[{"RepoTags":["registry.example.com/ci/app:1.0"]}]`}, http.StatusOK},
+		{"manifest not allowed", []string{"manifest.json", `[{"RepoTags":["evil.example/x:1.0"]}]`}, http.StatusForbidden},
+		{"repositories not allowed", []string{"repositories", `{"evil.example/x":{"1.0":"abc"}}`}, http.StatusForbidden},
+		{"oci", []string{"index.json", `{"manifests":[{"annotations":{"io.containerd.image.name":"registry.example.com/ci/app:1.0"}}]}`}, http.StatusOK},
+		{"oci not allowed", []string{"index.json", `{"manifests":[{"annotations":{"org.opencontainers.image.ref.name":"evil.example/x:1.0"}}]}`}, http.StatusForbidden},
+		// the docker manifest does not hide the names in the index
+		{"oci and manifest", []string{
+			"manifest.json", `[{"RepoTags":["registry.example.com/ci/app:1.0"]}]`,
+			"index.json", `{"manifests":[{"annotations":{"io.containerd.image.name":"evil.example/x:1.0"}}]}`,
+		}, http.StatusForbidden},
+		{"invalid index", []string{"index.json", `{`}, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/images/load", tarball(t, test.files...))
+		rec := httptest.NewRecorder()
+		r.checkImages(l, "POST", "/images/load", upstream).ServeHTTP(rec, req)
+		if rec.Code != test.expected {
+			t.Errorf("Status for %s was incorrect, got %d, want %d", test.name, rec.Code, test.expected)
+		}
+	}
+}
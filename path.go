@@ -0,0 +1,41 @@
+package dockerguard
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// canonicalPath ... rejects paths the daemon could resolve to another path than the one routes
+// are matched against, like /containers/mariadb/../other/stop, and strips a trailing slash
+func canonicalPath(u *url.URL) (string, error) {
+	path := u.Path
+	if !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("Path %q is not absolute", path)
+	}
+	for _, c := range path {
+		if c < 0x20 || c == 0x7f {
+			return "", fmt.Errorf("Path %q contains control characters", path)
+		}
+	}
+	// an encoded slash decodes to a separator that is not one in the path that was sent
+	if strings.Contains(strings.ToLower(u.EscapedPath()), "%2f") {
+		return "", fmt.Errorf("Path %q contains an encoded slash", u.EscapedPath())
+	}
+
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	for _, segment := range strings.Split(path, "/")[1:] {
+		switch segment {
+		case "":
+			if path != "/" {
+				return "", fmt.Errorf("Path %q contains empty segments", u.Path)
+			}
+		case ".", "..":
+			return "", fmt.Errorf("Path %q contains relative segments", u.Path)
+		}
+	}
+
+	return path, nil
+}
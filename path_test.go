@@ -0,0 +1,62 @@
+package dockerguard
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/micoud/dockerguard/config"
+)
+
+func TestPathBypass(t *testing.T) {
+	tests := []struct {
+		routes   string
+		method   string
+		target   string
+		expected int
+	}{
+		{"routes_start_stop_inspect_container_regex.json", "POST", "/v1.41/containers/mariadb/stop", http.StatusOK},
+		{"routes_start_stop_inspect_container_regex.json", "POST", "/v1.41/containers/mariadb/stop/", http.StatusOK},
+		{"routes_start_stop_inspect_container_regex.json", "POST", "/v1.41/containers/mariadb/../other/stop", http.StatusBadRequest},
+		{"routes_start_stop_inspect_container_regex.json", "POST", "/v1.41/containers/mariadb/%2e%2e/other/stop", http.StatusBadRequest},
+		{"routes_start_stop_inspect_container_regex.json", "POST", "/v1.41/containers/other/./mariadb/stop", http.StatusBadRequest},
+		{"routes_start_stop_inspect_container_regex.json", "POST", "/v1.41/containers/other%2Fmariadb/stop", http.StatusBadRequest},
+		{"routes_start_stop_inspect_container_regex.json", "POST", "/v1.41/containers/other%2fmariadb/stop", http.StatusBadRequest},
+		{"routes_start_stop_inspect_container_regex.json", "POST", "/v1.41/containers/other%00mariadb/stop", http.StatusBadRequest},
+		{"routes_start_stop_inspect_container_regex.json", "POST", "/v1.41/containers/other%0amariadb/stop", http.StatusBadRequest},
+		{"routes_start_stop_inspect_container_regex.json", "POST", "/v1.41/containers/other/stop", http.StatusForbidden},
+		{"routes_start_stop_inspect_container_regex.json", "GET", "//containers/json", http.StatusBadRequest},
+		{"routes_start_stop_inspect_container_regex.json", "GET", "/v1.41//containers/json", http.StatusBadRequest},
+		{"routes_start_stop_inspect_container_regex.json", "GET", "/v1.41/containers/json//", http.StatusBadRequest},
+		{"routes_start_stop_inspect_container_regex.json", "GET", "/v1.41/%63ontainers/json", http.StatusOK},
+		{"routes_exec_container_regex.json", "POST", "/exec/0123abc/start", http.StatusOK},
+		{"routes_exec_container_regex.json", "POST", "/exec/0123abc/start/../../../containers/x/exec", http.StatusBadRequest},
+		{"routes_exec_container_regex.json", "POST", "/containers/mariadb/exec/..", http.StatusBadRequest},
+		{"routes_create_container.json", "GET", "/containers/0123abc/json", http.StatusOK},
+		{"routes_create_container.json", "GET", "/containers/0123abc/json/.", http.StatusBadRequest},
+		{"routes_create_container.json", "POST", "/containers/0123abc/start/..%2f..%2fkill", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		routes := config.RoutesConfig("examples/" + test.routes)
+		r := &RulesDirector{RoutesAllowed: &routes}
+
+		var forwarded string
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			forwarded = req.URL.EscapedPath()
+		})
+
+		req := httptest.NewRequest(test.method, test.target, nil)
+		rec := httptest.NewRecorder()
+		r.Direct(log.New(ioutil.Discard, "", 0), req, upstream).ServeHTTP(rec, req)
+		if rec.Code != test.expected {
+			t.Errorf("Status for %s %s with %s was incorrect, got %d, want %d", test.method, test.target, test.routes, rec.Code, test.expected)
+		}
+		// the path that was matched is forwarded
+		if rec.Code == http.StatusOK && forwarded != req.URL.Path {
+			t.Errorf("Forwarded %s for %s, expected the canonical path %s", forwarded, test.target, req.URL.Path)
+		}
+	}
+}
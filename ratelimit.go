@@ -0,0 +1,165 @@
+package dockerguard
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/micoud/dockerguard/config"
+	"github.com/micoud/dockerguard/socketproxy"
+)
+
+const (
+	// buckets that are full again are dropped once a limiter has more of them, if
+	// that is not enough the ones used least recently are dropped as well
+	maxRateLimitBuckets = 10000
+)
+
+// tokenBucket ... tokens left for one key and when they were counted
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter ... token buckets of a rate limit by caller or IP
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	key   string
+
+	mu         sync.Mutex
+	buckets    map[string]*tokenBucket
+	maxBuckets int
+	allowed    int64
+	limited    int64
+}
+
+func newRateLimiter(c *config.RateLimit) *rateLimiter {
+	if c == nil {
+		return nil
+	}
+	return &rateLimiter{
+		rate:       c.Rate(),
+		burst:      float64(c.Size()),
+		key:        c.Key,
+		buckets:    map[string]*tokenBucket{},
+		maxBuckets: maxRateLimitBuckets,
+	}
+}
+
+// allow ... takes a token from the bucket of key, if there is none it returns
+// how long it takes until there is one again
+func (rl *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		if len(rl.buckets) >= rl.maxBuckets {
+			rl.prune(now)
+		}
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = rl.tokens(b, now)
+	b.last = now
+
+	if b.tokens < 1 {
+		rl.limited++
+		return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	b.tokens--
+	rl.allowed++
+	return true, 0
+}
+
+// tokens ... tokens in b at now
+func (rl *rateLimiter) tokens(b *tokenBucket, now time.Time) float64 {
+	return math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+}
+
+// prune ... drops buckets that are full, they are the same as new ones, and then the
+// buckets used least recently until a tenth of the maximum is free again
+func (rl *rateLimiter) prune(now time.Time) {
+	for key, b := range rl.buckets {
+		if rl.tokens(b, now) >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+
+	keep := rl.maxBuckets - rl.maxBuckets/10 - 1
+	if len(rl.buckets) <= keep {
+		return
+	}
+	keys := make([]string, 0, len(rl.buckets))
+	for key := range rl.buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return rl.buckets[keys[i]].last.Before(rl.buckets[keys[j]].last)
+	})
+	for _, key := range keys[:len(keys)-keep] {
+		delete(rl.buckets, key)
+	}
+}
+
+// state ... counters and the tokens left per key for the metrics
+func (rl *rateLimiter) state() map[string]interface{} {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	tokens := map[string]float64{}
+	for key, b := range rl.buckets {
+		tokens[key] = math.Floor(rl.tokens(b, now)*100) / 100
+	}
+	return map[string]interface{}{
+		"allowed": rl.allowed,
+		"limited": rl.limited,
+		"tokens":  tokens,
+	}
+}
+
+// limitKey ... key of a caller for rate and concurrency limits, callers are identified
+// like profiles are selected for them, other than by String() the PID of a peer is ignored
+func (c caller) limitKey(key string) string {
+	if key == config.RateLimitKeyIP {
+		return "ip=" + c.source()
+	}
+
+	switch {
+	case c.Token != "":
+		return "token=" + c.Token
+	case c.CommonName != "":
+		return "cn=" + c.CommonName
+	case c.Container != nil:
+		return "container=" + c.Container.Name
+	case c.Peer != nil:
+		return fmt.Sprintf("uid=%d gid=%d", c.Peer.UID, c.Peer.GID)
+	case c.SourceIP != nil:
+		return "ip=" + c.SourceIP.String()
+	}
+	return "anonymous"
+}
+
+// checkRateLimit ... handler that answers with 429 if the caller exceeds rl, nil if it does not
+func checkRateLimit(l socketproxy.Logger, rl *rateLimiter, c caller, scope string) http.Handler {
+	if rl == nil {
+		return nil
+	}
+	ok, retry := rl.allow(c.limitKey(rl.key), time.Now())
+	if ok {
+		return nil
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		msg := fmt.Sprintf("Rate limit of the %s exceeded for %s", scope, c.limitKey(rl.key))
+		l.Printf("%s", msg)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		writeError(w, msg, http.StatusTooManyRequests)
+	})
+}
@@ -0,0 +1,127 @@
+package dockerguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/micoud/dockerguard/config"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(&config.RateLimit{Requests: 1, Burst: 2})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.allow("a", now); !ok {
+			t.Errorf("Request %d of the burst should be allowed", i+1)
+		}
+	}
+	if ok, retry := rl.allow("a", now); ok || retry != time.Second {
+		t.Errorf("Request after the burst should be limited for 1s, got %v %s", ok, retry)
+	}
+	if ok, _ := rl.allow("b", now); !ok {
+		t.Errorf("Other keys should have buckets of their own")
+	}
+	if ok, retry := rl.allow("a", now.Add(500*time.Millisecond)); ok || retry != 500*time.Millisecond {
+		t.Errorf("Request after 500ms should be limited for 500ms, got %v %s", ok, retry)
+	}
+	if ok, _ := rl.allow("a", now.Add(time.Second)); !ok {
+		t.Errorf("Request after 1s should be allowed")
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	rl := newRateLimiter(&config.RateLimit{Requests: 1, Per: "1h", Burst: 1})
+	rl.maxBuckets = 100
+	now := time.Now()
+
+	// none of the buckets is full again, the ones used least recently are dropped
+	for i := 0; i < 1000; i++ {
+		rl.allow(fmt.Sprintf("caller-%d", i), now.Add(time.Duration(i)*time.Millisecond))
+		if len(rl.buckets) > rl.maxBuckets {
+			t.Fatalf("Limiter has %d buckets, expected at most %d", len(rl.buckets), rl.maxBuckets)
+		}
+	}
+	if _, ok := rl.buckets["caller-999"]; !ok {
+		t.Errorf("Bucket used last was dropped")
+	}
+	if _, ok := rl.buckets["caller-0"]; ok {
+		t.Errorf("Bucket used first was kept")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	r := &RulesDirector{RoutesAllowed: &config.RoutesAllowed{
+		RateLimit: &config.RateLimit{Requests: 1, Per: "1h", Burst: 5, Key: config.RateLimitKeyIP},
+		Routes: []config.Route{
+			{Method: "GET", Pattern: "^/containers/json$"},
+			{Method: "POST", Pattern: "^/containers/create$", RateLimit: &config.RateLimit{Requests: 2, Per: "1h"}},
+		},
+		Profiles: map[string]config.Profile{
+			"ci": {
+				Routes:    []config.Route{{Method: "GET", Pattern: "^/containers/json$"}},
+				RateLimit: &config.RateLimit{Requests: 1, Per: "1h"},
+			},
+		},
+		Identities: []config.Identity{{Profile: "ci", SourceCIDR: "10.0.1.0/24"}},
+	}}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	tests := []struct {
+		method     string
+		path       string
+		remoteAddr string
+		expected   int
+	}{
+		// route limit of 2 per caller
+		{"POST", "/containers/create", "10.0.0.1:1234", http.StatusOK},
+		{"POST", "/containers/create", "10.0.0.1:1234", http.StatusOK},
+		{"POST", "/containers/create", "10.0.0.1:1234", http.StatusTooManyRequests},
+		{"POST", "/containers/create", "10.0.0.2:1234", http.StatusOK},
+		// global limit of 5 per IP, the limited request above is counted as well
+		{"GET", "/containers/json", "10.0.0.1:1234", http.StatusOK},
+		{"GET", "/containers/json", "10.0.0.1:1234", http.StatusOK},
+		{"GET", "/_ping", "10.0.0.1:1234", http.StatusTooManyRequests},
+		{"GET", "/_ping", "10.0.0.2:1234", http.StatusOK},
+		// profile limit of 1
+		{"GET", "/containers/json", "10.0.1.1:1234", http.StatusOK},
+		{"GET", "/containers/json", "10.0.1.1:1234", http.StatusTooManyRequests},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		req.RemoteAddr = test.remoteAddr
+		rec := httptest.NewRecorder()
+		r.Direct(log.New(ioutil.Discard, "", 0), req, upstream).ServeHTTP(rec, req)
+		if rec.Code != test.expected {
+			t.Errorf("Status for %s %s from %s was incorrect, got %d, want %d", test.method, test.path, test.remoteAddr, rec.Code, test.expected)
+		}
+		if rec.Code != http.StatusTooManyRequests {
+			continue
+		}
+
+		var msg map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &msg); err != nil || msg["message"] == "" {
+			t.Errorf("Response is no docker error: %s", rec.Body.String())
+		}
+		if rec.Header().Get("Retry-After") == "" {
+			t.Errorf("Response to %s %s has no Retry-After header", test.method, test.path)
+		}
+	}
+
+	metrics := r.rateLimitMetrics().(map[string]interface{})
+	global := metrics["global"].(map[string]interface{})
+	if global["allowed"] != int64(9) || global["limited"] != int64(1) {
+		t.Errorf("Unexpected global rate limit metrics %v", global)
+	}
+	route := metrics[`route POST ^/containers/create$`].(map[string]interface{})
+	if fmt.Sprint(route["tokens"]) != "map[ip=10.0.0.1:0 ip=10.0.0.2:1]" {
+		t.Errorf("Unexpected tokens of the route %v", route["tokens"])
+	}
+}
@@ -0,0 +1,237 @@
+package dockerguard
+
+import (
+	"expvar"
+	"net"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/micoud/dockerguard/config"
+	"github.com/micoud/dockerguard/socketproxy"
+)
+
+const (
+	// regexes compiled from values of the config, the cache is reset when it is full
+	maxCachedRegexps = 4096
+)
+
+var (
+	regexpCacheMu sync.RWMutex
+	regexpCache   = map[string]*regexp.Regexp{}
+)
+
+// cachedRegexp ... compiles pattern like regexp.MustCompile, but only once
+func cachedRegexp(pattern string) *regexp.Regexp {
+	regexpCacheMu.RLock()
+	re, ok := regexpCache[pattern]
+	regexpCacheMu.RUnlock()
+	if ok {
+		return re
+	}
+
+	re = regexp.MustCompile(pattern)
+	regexpCacheMu.Lock()
+	if len(regexpCache) >= maxCachedRegexps {
+		regexpCache = map[string]*regexp.Regexp{}
+	}
+	regexpCache[pattern] = re
+	regexpCacheMu.Unlock()
+
+	return re
+}
+
+// indexedRoute ... route with its compiled pattern, its parsed sources and its limiters
+type indexedRoute struct {
+	config.Route
+	re      *regexp.Regexp
+	sources []*net.IPNet
+	limiter *rateLimiter
+
+	// concurrency limits in total and per caller
+	concurrent          *socketproxy.ConcurrencyLimiter
+	concurrentPerCaller *socketproxy.ConcurrencyLimiter
+}
+
+// routeIndex ... routes by method and the static prefix of the paths their pattern can
+// match, routes without a static prefix are kept under the prefix ""
+type routeIndex struct {
+	routes   []indexedRoute
+	byPrefix map[string]map[string][]int
+
+	// rate limiter of the profile
+	limiter *rateLimiter
+}
+
+func newRouteIndex(routes []config.Route) *routeIndex {
+	ix := &routeIndex{byPrefix: map[string]map[string][]int{}}
+	for i, route := range routes {
+		ir := indexedRoute{
+			Route:   route,
+			re:      regexp.MustCompile(route.Pattern),
+			sources: config.MustParseSources(route.AllowedSources),
+			limiter: newRateLimiter(route.RateLimit),
+		}
+		if c := route.Concurrency; c != nil {
+			if c.Max > 0 {
+				ir.concurrent = socketproxy.NewConcurrencyLimiter(c.Max, c.Timeout())
+			}
+			if c.MaxPerCaller > 0 {
+				ir.concurrentPerCaller = socketproxy.NewConcurrencyLimiter(c.MaxPerCaller, c.Timeout())
+			}
+		}
+		ix.routes = append(ix.routes, ir)
+
+		prefixes, ok := ix.byPrefix[route.Method]
+		if !ok {
+			prefixes = map[string][]int{}
+			ix.byPrefix[route.Method] = prefixes
+		}
+		prefix := staticPrefix(route.Pattern)
+		prefixes[prefix] = append(prefixes[prefix], i)
+	}
+	return ix
+}
+
+// candidates ... routes that might match a request, in the order of the config
+func (ix *routeIndex) candidates(method string, path string) []indexedRoute {
+	if ix == nil {
+		return nil
+	}
+	methods := []string{method, "*"}
+	if method == "*" {
+		methods = methods[:1]
+	}
+
+	// every prefix of the path is looked up once, so every route is found once
+	var indexes []int
+	for _, m := range methods {
+		prefixes := ix.byPrefix[m]
+		if len(prefixes) == 0 {
+			continue
+		}
+		for i := 0; i <= len(path); i++ {
+			indexes = append(indexes, prefixes[path[:i]]...)
+		}
+	}
+	sort.Ints(indexes)
+
+	routes := make([]indexedRoute, len(indexes))
+	for i, n := range indexes {
+		routes[i] = ix.routes[n]
+	}
+	return routes
+}
+
+// staticPrefix ... literal every path a pattern can match starts with, if the pattern starts
+// with ^/ followed by a literal, e.g. "/services/web_" for ^/services/web_[^/]+$
+func staticPrefix(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 || re.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	lit := re.Sub[1]
+	if lit.Op != syntax.OpLiteral || lit.Flags&syntax.FoldCase != 0 {
+		return ""
+	}
+
+	prefix := string(lit.Rune)
+	if !strings.HasPrefix(prefix, "/") {
+		return ""
+	}
+	return prefix
+}
+
+// routes ... index of the routes of a profile, "" for routes_allowed
+func (r *RulesDirector) routes(profile string) *routeIndex {
+	r.routesOnce.Do(func() {
+		r.indexes = map[string]*routeIndex{"": newRouteIndex(r.RoutesAllowed.Routes)}
+		for name, p := range r.RoutesAllowed.Profiles {
+			r.indexes[name] = newRouteIndex(p.Routes)
+			r.indexes[name].limiter = newRateLimiter(p.RateLimit)
+		}
+		r.limiter = newRateLimiter(r.RoutesAllowed.RateLimit)
+		r.sources = config.MustParseSources(r.RoutesAllowed.AllowedSources)
+		for _, id := range r.RoutesAllowed.Identities {
+			ii := indexedIdentity{Identity: id}
+			if id.SourceCIDR != "" {
+				ii.sources = config.MustParseSources([]string{id.SourceCIDR})
+			}
+			r.identities = append(r.identities, ii)
+		}
+		socketproxy.PublishMetrics(r.Name, "rate_limits", expvar.Func(r.rateLimitMetrics))
+		socketproxy.PublishMetrics(r.Name, "concurrency", expvar.Func(r.concurrencyMetrics))
+	})
+	return r.indexes[profile]
+}
+
+// globalLimiter ... rate limiter of all requests, it is created with the indexes
+func (r *RulesDirector) globalLimiter() *rateLimiter {
+	r.routes("")
+	return r.limiter
+}
+
+// globalSources ... sources all requests have to come from, they are parsed with the indexes
+func (r *RulesDirector) globalSources() []*net.IPNet {
+	r.routes("")
+	return r.sources
+}
+
+// identityIndex ... identities with their parsed sources, they are parsed with the indexes
+func (r *RulesDirector) identityIndex() []indexedIdentity {
+	r.routes("")
+	return r.identities
+}
+
+// rateLimitMetrics ... state of the rate limiters by scope
+func (r *RulesDirector) rateLimitMetrics() interface{} {
+	m := map[string]interface{}{}
+	if r.limiter != nil {
+		m["global"] = r.limiter.state()
+	}
+	for name, ix := range r.indexes {
+		if ix.limiter != nil {
+			m["profile "+name] = ix.limiter.state()
+		}
+		for _, route := range ix.routes {
+			if route.limiter != nil {
+				m[routeScope(name, route.Route)] = route.limiter.state()
+			}
+		}
+	}
+	return m
+}
+
+// concurrencyMetrics ... requests that run or wait by route and caller
+func (r *RulesDirector) concurrencyMetrics() interface{} {
+	m := map[string]interface{}{}
+	for name, ix := range r.indexes {
+		for _, route := range ix.routes {
+			state := map[string]interface{}{}
+			if route.concurrent != nil {
+				state["total"] = route.concurrent.State()[""]
+			}
+			if route.concurrentPerCaller != nil {
+				state["callers"] = route.concurrentPerCaller.State()
+			}
+			if len(state) > 0 {
+				m[routeScope(name, route.Route)] = state
+			}
+		}
+	}
+	return m
+}
+
+// routeScope ... name of a route in metrics and errors
+func routeScope(profile string, route config.Route) string {
+	if profile == "" {
+		return "route " + route.Method + " " + route.Pattern
+	}
+	return "route " + route.Method + " " + route.Pattern + " of profile " + profile
+}
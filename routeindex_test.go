@@ -0,0 +1,143 @@
+package dockerguard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/micoud/dockerguard/config"
+)
+
+func TestStaticPrefix(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{`^/containers/json$`, "/containers/json"},
+		{`^/containers/[^/]+/start$`, "/containers/"},
+		{`^/info$`, "/info"},
+		{`^/info`, "/info"},
+		{`^/networks/stack1_[^/]+$`, "/networks/stack1_"},
+		{`^/containersx?/json$`, "/containers"},
+		{`^/(containers|images)/json$`, "/"},
+		{`^(/containers)/json$`, ""},
+		{`/containers/json`, ""},
+		{`(?i)^/containers/json$`, ""},
+		{`^/${caller.name}/json$`, "/"},
+		{`^/services/${caller.stack}_.+$`, "/services/"},
+	}
+
+	for _, test := range tests {
+		if s := staticPrefix(test.pattern); s != test.expected {
+			t.Errorf("Prefix of %s is '%s', expected '%s'", test.pattern, s, test.expected)
+		}
+	}
+}
+
+func TestRouteIndex(t *testing.T) {
+	ix := newRouteIndex([]config.Route{
+		{Method: "GET", Pattern: `^/containers/json$`},
+		{Method: "*", Pattern: `^/containers/.+$`},
+		{Method: "GET", Pattern: `^/images/json$`},
+		{Method: "GET", Pattern: `/json$`},
+		{Method: "POST", Pattern: `^/containers/create$`},
+		{Method: "GET", Pattern: `^/networks/stack1_[^/]+$`},
+		{Method: "GET", Pattern: `^/networks/stack10_[^/]+$`},
+		{Method: "*", Pattern: `.*`},
+	})
+
+	tests := []struct {
+		method   string
+		path     string
+		expected []string
+	}{
+		{"GET", "/containers/json", []string{`^/containers/json$`, `^/containers/.+$`, `/json$`, `.*`}},
+		{"POST", "/containers/create", []string{`^/containers/.+$`, `^/containers/create$`, `.*`}},
+		{"GET", "/networks/stack10_web", []string{`/json$`, `^/networks/stack10_[^/]+$`, `.*`}},
+		// routes without a prefix are candidates once
+		{"GET", "", []string{`/json$`, `.*`}},
+		{"*", "/info", []string{`.*`}},
+	}
+
+	for _, test := range tests {
+		var patterns []string
+		for _, route := range ix.candidates(test.method, test.path) {
+			patterns = append(patterns, route.Pattern)
+		}
+		if fmt.Sprint(patterns) != fmt.Sprint(test.expected) {
+			t.Errorf("Candidates of %s %s are %v, expected %v in the order of the config", test.method, test.path, patterns, test.expected)
+		}
+	}
+}
+
+// largePolicy ... routes for n stacks with a few routes each
+func largePolicy(n int) []config.Route {
+	var routes []config.Route
+	for i := 0; i < n; i++ {
+		routes = append(routes,
+			config.Route{Method: "GET", Pattern: fmt.Sprintf(`^/services/stack%d_[^/]+$`, i)},
+			config.Route{Method: "POST", Pattern: fmt.Sprintf(`^/services/stack%d_[^/]+/update$`, i)},
+			config.Route{Method: "GET", Pattern: fmt.Sprintf(`^/containers/stack%d_[^/]+/json$`, i)},
+			config.Route{Method: "POST", Pattern: fmt.Sprintf(`^/volumes/stack%d_[^/]+$`, i)},
+			config.Route{Method: "GET", Pattern: fmt.Sprintf(`^/networks/stack%d_[^/]+$`, i)},
+		)
+	}
+	return append(routes, config.Route{Method: "GET", Pattern: `^/tasks$`})
+}
+
+func BenchmarkRouteMatch(b *testing.B) {
+	routes := largePolicy(200)
+	ix := newRouteIndex(routes)
+	path := "/tasks"
+
+	b.Run("compile-per-request", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, route := range routes {
+				if route.Method == "GET" && regexp.MustCompile(route.Pattern).MatchString(path) {
+					break
+				}
+			}
+		}
+	})
+	b.Run("precompiled-scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, route := range ix.routes {
+				if route.Method == "GET" && route.re.MatchString(path) {
+					break
+				}
+			}
+		}
+	})
+	b.Run("indexed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, route := range ix.candidates("GET", path) {
+				if route.re.MatchString(path) {
+					break
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkDirect(b *testing.B) {
+	director := &RulesDirector{
+		Client:        &http.Client{},
+		RoutesAllowed: &config.RoutesAllowed{Routes: largePolicy(200)},
+	}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	l := log.New(ioutil.Discard, "", 0)
+	req := httptest.NewRequest("GET", "/v1.41/networks/stack150_backend", nil)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		director.Direct(l, req, upstream).ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			b.Fatalf("Unexpected status %d", w.Code)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package socketproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TokenAuth authenticates requests by a bearer token or the password of basic auth,
+// tokens are only known by their sha256 hashes
+type TokenAuth struct {
+	names  []string
+	hashes [][]byte
+}
+
+type tokenKey struct{}
+
+// NewTokenAuth returns a TokenAuth for a map of hex encoded sha256 hashes to token names
+func NewTokenAuth(hashes map[string]string) (*TokenAuth, error) {
+	a := &TokenAuth{}
+	for h, name := range hashes {
+		sum, err := hex.DecodeString(h)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha256 hash for token %s", name)
+		}
+		a.names = append(a.names, name)
+		a.hashes = append(a.hashes, sum)
+	}
+	return a, nil
+}
+
+// Authenticate returns the name of the token sent with req
+func (a *TokenAuth) Authenticate(req *http.Request) (string, error) {
+	var token string
+	if _, pass, ok := req.BasicAuth(); ok {
+		token = pass
+	} else if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	if token == "" {
+		return "", errors.New("missing token")
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	name := ""
+	for i, h := range a.hashes {
+		// compare all hashes to not leak which one matched
+		if subtle.ConstantTimeCompare(sum[:], h) == 1 {
+			name = a.names[i]
+		}
+	}
+	if name == "" {
+		return "", errors.New("invalid token")
+	}
+
+	return name, nil
+}
+
+// TokenFromContext returns the name of the token a request was authenticated with, if any
+func TokenFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(tokenKey{}).(string)
+	return name, ok
+}
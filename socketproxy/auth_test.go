@@ -0,0 +1,44 @@
+package socketproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenAuth(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret"))
+	auth, err := NewTokenAuth(map[string]string{hex.EncodeToString(sum[:]): "agent-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"Bearer s3cret", "agent-1"},
+		{"Basic " + "YWdlbnQ6czNjcmV0", "agent-1"}, // agent:s3cret
+		{"Bearer wrong", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/_ping", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		name, err := auth.Authenticate(req)
+		if name != test.expected {
+			t.Errorf("Token name for '%s' was incorrect, got '%s', want '%s'", test.header, name, test.expected)
+		}
+		if test.expected == "" && err == nil {
+			t.Errorf("Authentication with '%s' should have failed", test.header)
+		}
+	}
+
+	if _, err := NewTokenAuth(map[string]string{"abc": "broken"}); err == nil {
+		t.Errorf("Invalid hash should be rejected")
+	}
+}
@@ -0,0 +1,39 @@
+package socketproxy
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrBodyTooLarge is returned when more is read from a body than LimitBody allows
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// limitedBody ... body that fails with ErrBodyTooLarge after n bytes
+type limitedBody struct {
+	io.ReadCloser
+	n int64
+}
+
+// LimitBody returns body, reading more than max bytes from it fails with ErrBodyTooLarge. Unlike
+// a check of Content-Length this also limits chunked bodies.
+func LimitBody(body io.ReadCloser, max int64) io.ReadCloser {
+	return &limitedBody{ReadCloser: body, n: max}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.n < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// read one byte more than allowed to notice bodies that are too large
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n -= int64(n)
+	if b.n < 0 {
+		return n + int(b.n), ErrBodyTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,102 @@
+package socketproxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTooManyRequests is returned when no slot of a ConcurrencyLimiter got free in time
+	ErrTooManyRequests = errors.New("too many concurrent requests")
+)
+
+// ConcurrencyLimiter limits how many requests run at the same time for each key, requests
+// over the limit wait up to the queue timeout for a slot, or fail at once without one
+type ConcurrencyLimiter struct {
+	max          int
+	queueTimeout time.Duration
+
+	mu    sync.Mutex
+	slots map[string]*concurrencySlots
+}
+
+// concurrencySlots ... semaphore of one key and how many requests use or wait for it
+type concurrencySlots struct {
+	sem   chan struct{}
+	users int
+}
+
+// NewConcurrencyLimiter returns a limiter for max requests per key
+func NewConcurrencyLimiter(max int, queueTimeout time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		max:          max,
+		queueTimeout: queueTimeout,
+		slots:        map[string]*concurrencySlots{},
+	}
+}
+
+// Acquire takes a slot for key, the returned function gives it back
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context, key string) (func(), error) {
+	cl.mu.Lock()
+	s, ok := cl.slots[key]
+	if !ok {
+		s = &concurrencySlots{sem: make(chan struct{}, cl.max)}
+		cl.slots[key] = s
+	}
+	s.users++
+	cl.mu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			<-s.sem
+			cl.done(key, s)
+		})
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if cl.queueTimeout > 0 {
+		timer := time.NewTimer(cl.queueTimeout)
+		defer timer.Stop()
+
+		select {
+		case s.sem <- struct{}{}:
+			return release, nil
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+
+	cl.done(key, s)
+	return nil, ErrTooManyRequests
+}
+
+// done ... drops the slots of key once nobody uses them anymore
+func (cl *ConcurrencyLimiter) done(key string, s *concurrencySlots) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	s.users--
+	if s.users == 0 {
+		delete(cl.slots, key)
+	}
+}
+
+// State returns how many requests run or wait per key
+func (cl *ConcurrencyLimiter) State() map[string]int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	state := map[string]int{}
+	for key, s := range cl.slots {
+		state[key] = s.users
+	}
+	return state
+}
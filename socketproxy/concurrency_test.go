@@ -0,0 +1,51 @@
+package socketproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	cl := NewConcurrencyLimiter(2, 0)
+	ctx := context.Background()
+
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := cl.Acquire(ctx, "a")
+		if err != nil {
+			t.Fatalf("Slot %d should be free: %v", i+1, err)
+		}
+		releases = append(releases, release)
+	}
+	if _, err := cl.Acquire(ctx, "a"); err != ErrTooManyRequests {
+		t.Errorf("Third slot should not be free, got %v", err)
+	}
+	release, err := cl.Acquire(ctx, "b")
+	if err != nil {
+		t.Errorf("Other keys should have slots of their own: %v", err)
+	}
+	release()
+
+	// releasing twice frees only one slot
+	releases[0]()
+	releases[0]()
+	if n := cl.State()["a"]; n != 1 {
+		t.Errorf("One request should be left, got %d", n)
+	}
+	releases[1]()
+	if len(cl.State()) != 0 {
+		t.Errorf("Slots should be dropped when they are unused, got %v", cl.State())
+	}
+
+	// a cancelled request stops waiting
+	cl = NewConcurrencyLimiter(1, time.Minute)
+	if _, err := cl.Acquire(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := cl.Acquire(cancelled, "a"); err != ErrTooManyRequests {
+		t.Errorf("Cancelled request should not get a slot, got %v", err)
+	}
+}
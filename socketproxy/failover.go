@@ -0,0 +1,154 @@
+package socketproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// timeout for the /_ping of a health check
+	healthCheckTimeout = 5 * time.Second
+)
+
+var (
+	// ErrNoUpstream is returned by Dial if none of the upstreams can be reached
+	ErrNoUpstream = errors.New("no upstream available")
+)
+
+// Upstreams is a list of upstreams that are tried in order, connections go to the first
+// one that is healthy, unhealthy ones are only tried if no healthy one can be reached
+type Upstreams struct {
+	list []*Upstream
+
+	mu        sync.Mutex
+	unhealthy map[*Upstream]bool
+}
+
+// NewUpstreams returns the upstreams for a comma separated list of addresses like for
+// ParseUpstream, all tcp upstreams use tlsConfig
+func NewUpstreams(addrs string, tlsConfig *tls.Config) (*Upstreams, error) {
+	us := &Upstreams{unhealthy: map[*Upstream]bool{}}
+	for _, addr := range strings.Split(addrs, ",") {
+		u, err := ParseUpstream(strings.TrimSpace(addr), tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		us.list = append(us.list, u)
+	}
+	return us, nil
+}
+
+func (us *Upstreams) String() string {
+	names := make([]string, len(us.list))
+	for i, u := range us.list {
+		names[i] = u.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// Dial connects to the first upstream that can be reached, healthy ones first
+func (us *Upstreams) Dial(ctx context.Context) (net.Conn, *Upstream, error) {
+	var healthy, unhealthy []*Upstream
+	us.mu.Lock()
+	for _, u := range us.list {
+		if us.unhealthy[u] {
+			unhealthy = append(unhealthy, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+	us.mu.Unlock()
+
+	var errs []string
+	for _, u := range append(healthy, unhealthy...) {
+		conn, err := u.Dial(ctx)
+		us.setHealthy(u, err == nil)
+		if err == nil {
+			return conn, u, nil
+		}
+		errs = append(errs, err.Error())
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, nil, fmt.Errorf("%w: %s", ErrNoUpstream, strings.Join(errs, "; "))
+}
+
+// HealthCheck pings all upstreams every interval until ctx is done
+func (us *Upstreams) HealthCheck(ctx context.Context, l Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, u := range us.list {
+			err := u.ping(ctx)
+			us.mu.Lock()
+			changed := us.unhealthy[u] != (err != nil)
+			us.mu.Unlock()
+			if changed && err != nil {
+				l.Printf("Upstream %s is unhealthy: %v", u, err)
+			} else if changed {
+				l.Printf("Upstream %s is healthy", u)
+			}
+			us.setHealthy(u, err == nil)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (us *Upstreams) setHealthy(u *Upstream, healthy bool) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if healthy {
+		delete(us.unhealthy, u)
+	} else {
+		us.unhealthy[u] = true
+	}
+}
+
+// ping ... GET /_ping on a new connection to the upstream
+func (u *Upstream) ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	conn, err := u.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	req, err := http.NewRequest("GET", "http://docker/_ping", nil)
+	if err != nil {
+		return err
+	}
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
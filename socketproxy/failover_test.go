@@ -0,0 +1,83 @@
+package socketproxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpstreamFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "up.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	})}
+	go daemon.Serve(listener)
+	defer daemon.Close()
+
+	down := "unix://" + filepath.Join(dir, "down.sock")
+	up := "unix://" + filepath.Join(dir, "up.sock")
+	us, err := NewUpstreams(down+","+up, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, u, err := us.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if u.String() != up {
+		t.Errorf("Dialed %s instead of %s", u, up)
+	}
+	if !us.unhealthy[us.list[0]] {
+		t.Errorf("Failed upstream should be marked unhealthy")
+	}
+
+	// the health check fixes a wrong state
+	us.setHealthy(us.list[0], true)
+	us.setHealthy(us.list[1], false)
+	ctx, cancel := context.WithCancel(context.Background())
+	go us.HealthCheck(ctx, log.New(ioutil.Discard, "", 0), time.Hour)
+	healthy := false
+	for i := 0; i < 100 && !healthy; i++ {
+		time.Sleep(10 * time.Millisecond)
+		us.mu.Lock()
+		healthy = us.unhealthy[us.list[0]] && !us.unhealthy[us.list[1]]
+		us.mu.Unlock()
+	}
+	cancel()
+	if !healthy {
+		t.Errorf("Health check did not update the upstreams")
+	}
+
+	// without any upstream the proxy answers with a docker API error
+	us, _ = NewUpstreams(down, nil)
+	if _, _, err := us.Dial(context.Background()); !errors.Is(err, ErrNoUpstream) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	proxy := New(us, DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		return upstream
+	}))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/_ping", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "{\"message\":\"No docker daemon available\"}\n" {
+		t.Errorf("Unexpected response %d %s", w.Code, w.Body.String())
+	}
+}
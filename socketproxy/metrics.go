@@ -0,0 +1,104 @@
+package socketproxy
+
+import (
+	"bufio"
+	"expvar"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+var (
+	// metrics of all proxies by name, published as "dockerguard" on /debug/vars
+	metrics = expvar.NewMap("dockerguard")
+
+	metricsMu sync.Mutex
+	byName    = map[string]*listenerMetrics{}
+)
+
+// listenerMetrics ... counters of one proxy
+type listenerMetrics struct {
+	requests expvar.Int
+	active   expvar.Int
+	hijacked expvar.Int
+	status   expvar.Map
+
+	// all of the above and what is published with PublishMetrics
+	vars *expvar.Map
+}
+
+// newListenerMetrics ... registers the counters of a proxy under its name, proxies
+// with the same name share them
+func newListenerMetrics(name string) *listenerMetrics {
+	if name == "" {
+		name = "default"
+	}
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	if m, ok := byName[name]; ok {
+		return m
+	}
+
+	m := &listenerMetrics{}
+	m.status.Init()
+	v := new(expvar.Map).Init()
+	v.Set("requests", &m.requests)
+	v.Set("active", &m.active)
+	v.Set("hijacked", &m.hijacked)
+	v.Set("status", &m.status)
+	m.vars = v
+	metrics.Set(name, v)
+	byName[name] = m
+	return m
+}
+
+// PublishMetrics publishes v under key next to the counters of the proxy with the given name
+func PublishMetrics(name string, key string, v expvar.Var) {
+	newListenerMetrics(name).vars.Set(key, v)
+}
+
+// statusRecorder ... ResponseWriter that counts the status code written
+type statusRecorder struct {
+	http.ResponseWriter
+	metrics *listenerMetrics
+	written bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.written {
+		s.written = true
+		s.metrics.status.Add(strconv.Itoa(code), 1)
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if !s.written {
+		s.WriteHeader(http.StatusOK)
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack ... the response of a hijacked connection is streamed from upstream
+// as is, so it is only counted as hijacked
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err == nil {
+		s.written = true
+		s.metrics.hijacked.Add(1)
+	}
+	return conn, bufrw, err
+}
@@ -0,0 +1,39 @@
+package socketproxy
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	upstreams, _ := NewUpstreams("unix:///nonexistent.sock", nil)
+	proxy := New(upstreams, DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			writeError(w, "Endpoint not allowed", http.StatusForbidden)
+		})
+	}))
+	proxy.Name = "metrics-test"
+
+	m := newListenerMetrics("metrics-test")
+	requests := m.requests.Value()
+	var denied int64
+	if v, ok := m.status.Get("403").(*expvar.Int); ok {
+		denied = v.Value()
+	}
+
+	for i := 0; i < 2; i++ {
+		proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/containers/json", nil))
+	}
+
+	if m != proxy.metrics {
+		t.Fatalf("Metrics of the same name should be shared")
+	}
+	if m.requests.Value() != requests+2 || m.active.Value() != 0 {
+		t.Errorf("Unexpected request counts: %s", metrics.Get("metrics-test"))
+	}
+	if m.status.Get("403").(*expvar.Int).Value() != denied+2 {
+		t.Errorf("Unexpected status counts: %s", m.status.String())
+	}
+}
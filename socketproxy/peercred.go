@@ -0,0 +1,37 @@
+package socketproxy
+
+import (
+	"context"
+	"net"
+)
+
+// PeerCred holds the credentials of the process connected to a unix socket
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+type peerCredKey struct{}
+
+// ConnContext is meant to be used as http.Server.ConnContext, it stores the credentials
+// of clients connected via unix sockets in the context of their requests
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+
+	cred, err := getPeerCred(uc)
+	if err != nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// PeerCredFromContext returns the credentials stored by ConnContext, if any
+func PeerCredFromContext(ctx context.Context) (PeerCred, bool) {
+	cred, ok := ctx.Value(peerCredKey{}).(PeerCred)
+	return cred, ok
+}
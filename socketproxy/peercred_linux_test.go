@@ -0,0 +1,76 @@
+//go:build linux
+// +build linux
+
+package socketproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// accepted ... server and client side of a new connection to listener
+func accepted(t *testing.T, listener net.Listener, dial func() (net.Conn, error)) (net.Conn, net.Conn) {
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(conns)
+			return
+		}
+		conns <- conn
+	}()
+
+	client, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, ok := <-conns
+	if !ok {
+		t.Fatal("Connection was not accepted")
+	}
+	return conn, client
+}
+
+func TestConnContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dockerguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "proxy.sock")
+	unixListener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixListener.Close()
+
+	conn, client := accepted(t, unixListener, func() (net.Conn, error) { return net.Dial("unix", sock) })
+	defer conn.Close()
+	defer client.Close()
+	cred, ok := PeerCredFromContext(ConnContext(context.Background(), conn))
+	if !ok {
+		t.Fatal("No credentials stored for a unix connection")
+	}
+	if cred.UID != uint32(os.Getuid()) || cred.GID != uint32(os.Getgid()) || cred.PID != int32(os.Getpid()) {
+		t.Errorf("Credentials were incorrect, got %+v, want uid=%d gid=%d pid=%d", cred, os.Getuid(), os.Getgid(), os.Getpid())
+	}
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+
+	conn, client = accepted(t, tcpListener, func() (net.Conn, error) { return net.Dial("tcp", tcpListener.Addr().String()) })
+	defer conn.Close()
+	defer client.Close()
+	if cred, ok := PeerCredFromContext(ConnContext(context.Background(), conn)); ok {
+		t.Errorf("Credentials stored for a TCP connection: %+v", cred)
+	}
+}
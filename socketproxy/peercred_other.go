@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package socketproxy
+
+import (
+	"errors"
+	"net"
+)
+
+// getPeerCred is only supported on linux
+func getPeerCred(c *net.UnixConn) (PeerCred, error) {
+	return PeerCred{}, errors.New("peer credentials are not supported on this platform")
+}
@@ -1,28 +1,61 @@
 package socketproxy
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"os"
+	"regexp"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/kvz/logstreamer"
 )
 
+const (
+	// idle connections kept open to the upstreams
+	maxIdleUpstreamConns = 16
+	idleUpstreamTimeout  = 90 * time.Second
+)
+
 var (
 	Debug bool
+
+	// requests to these endpoints are streams that are hijacked by the daemon, even
+	// without an Upgrade header, requests to other endpoints are never hijacked
+	streamPathRegex = regexp.MustCompile(`^(/v[0-9.]+)?/(containers/[^/]+/attach|exec/[^/]+/start|session|grpc)$`)
+
+	// ids of requests are unique over all proxies
+	counter uint64
 )
 
 type SocketProxy struct {
-	path     string
-	sock     net.Conn
-	counter  uint64
-	director Director
+	upstreams *Upstreams
+	director  Director
+
+	// Transport keeps a pool of connections to the upstreams for requests that are no streams,
+	// other clients of the upstreams can share it
+	Transport *http.Transport
+
+	metricsOnce sync.Once
+	metrics     *listenerMetrics
+
+	// hijacked streams that are still running
+	streams sync.WaitGroup
+
+	// Name, if set, prefixes the log of requests and names the metrics of the proxy
+	Name string
+
+	// Auth, if set, rejects requests without a valid token
+	Auth *TokenAuth
 }
 
 // Logger is a subset of log.Logger used in a Proxy request
@@ -42,32 +75,170 @@ func (d DirectorFunc) Direct(l Logger, req *http.Request, upstream http.Handler)
 	return d(l, req, upstream)
 }
 
-// New returns a SocketProxy that proxies requests to the provided upstream unix socket
-func New(upstream string, director Director) *SocketProxy {
+// New returns a SocketProxy that proxies requests to the first available of the upstreams
+func New(upstreams *Upstreams, director Director) *SocketProxy {
 	return &SocketProxy{
-		path:     upstream,
-		director: director,
+		upstreams: upstreams,
+		director:  director,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				conn, _, err := upstreams.Dial(ctx)
+				return conn, err
+			},
+			MaxIdleConnsPerHost: maxIdleUpstreamConns,
+			IdleConnTimeout:     idleUpstreamTimeout,
+		},
 	}
 }
 
 func (s *SocketProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	requestID := atomic.AddUint64(&s.counter, 1)
+	requestID := atomic.AddUint64(&counter, 1)
 	path := req.URL.Path
 
 	if req.URL.RawQuery != "" {
 		path += "?" + req.URL.RawQuery
 	}
 
-	l := log.New(os.Stderr, fmt.Sprintf("#%d ", requestID), log.Ltime|log.Lmicroseconds)
+	s.metricsOnce.Do(func() {
+		s.metrics = newListenerMetrics(s.Name)
+	})
+	s.metrics.requests.Add(1)
+	s.metrics.active.Add(1)
+	defer s.metrics.active.Add(-1)
+	w = &statusRecorder{ResponseWriter: w, metrics: s.metrics}
+
+	prefix := fmt.Sprintf("#%d ", requestID)
+	if s.Name != "" {
+		prefix = fmt.Sprintf("[%s] %s", s.Name, prefix)
+	}
+	l := log.New(os.Stderr, prefix, log.Ltime|log.Lmicroseconds)
 	l.Printf("%s - %s - %db", req.Method, path, req.ContentLength)
+	if cred, ok := PeerCredFromContext(req.Context()); ok {
+		l.Printf("Peer pid=%d uid=%d gid=%d", cred.PID, cred.UID, cred.GID)
+	}
+
+	if s.Auth != nil {
+		name, err := s.Auth.Authenticate(req)
+		if err != nil {
+			l.Printf("Authentication failed: %v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dockerguard"`)
+			writeError(w, "Authentication failed: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		l.Printf("Authenticated as %s", name)
+
+		// the token is not meant for upstream
+		req.Header.Del("Authorization")
+		req = req.WithContext(context.WithValue(req.Context(), tokenKey{}, name))
+	}
 
 	var passUpstream = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		s.ServeViaUpstreamSocket(l, w, req)
+		if isStream(req) {
+			s.ServeViaUpstreamSocket(l, w, req)
+			return
+		}
+
+		// an upgrade would hand the connection over to the daemon, later requests on it
+		// would not be passed via the director
+		if req.Header.Get("Upgrade") != "" {
+			l.Printf("Ignoring upgrade to %s of a request that is not a stream", req.Header.Get("Upgrade"))
+			req.Header.Del("Upgrade")
+			req.Header.Del("Connection")
+		}
+		s.ServeViaReverseProxy(l, w, req)
 	})
 
 	s.director.Direct(l, req, passUpstream).ServeHTTP(w, req)
 }
 
+// Drain waits until all hijacked streams are done or ctx is done. It must only be called
+// after the server stopped serving requests, i.e. after http.Server.Shutdown returned.
+func (s *SocketProxy) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.streams.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeError writes msg in the JSON format of docker API errors
+func writeError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"message": msg,
+	})
+}
+
+// testHookHijacked is called right after a connection was hijacked
+var testHookHijacked = func() {}
+
+// isStream ... true for requests to endpoints of raw streams like attach and exec
+func isStream(req *http.Request) bool {
+	return streamPathRegex.MatchString(req.URL.Path)
+}
+
+// ServeViaReverseProxy forwards a request that is not upgraded to a stream and its response
+// on a pooled connection, the downstream connection is kept alive and further requests on it
+// are passed via the director as well
+func (s *SocketProxy) ServeViaReverseProxy(l *log.Logger, w http.ResponseWriter, req *http.Request) {
+	// streamed responses like logs are limited like streams, the request to the daemon
+	// is canceled when a limit is hit
+	limits, _ := StreamLimitsFromContext(req.Context())
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	if limits.MaxDuration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, limits.MaxDuration)
+		defer cancel()
+	}
+	req = req.WithContext(ctx)
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = "docker"
+		},
+		Transport: s.Transport,
+		// responses like logs and events are streamed
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			if Debug {
+				l.Printf("Upstream responded %s", resp.Status)
+			}
+			if limits.IdleTimeout > 0 || limits.MaxBytesOut > 0 {
+				// the maximum duration is up to the context already
+				stream := newLimitedStream(l, StreamLimits{IdleTimeout: limits.IdleTimeout}, cancel)
+				resp.Body = &limitedResponse{ReadCloser: resp.Body, stream: stream, max: limits.MaxBytesOut}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			l.Printf("Error forwarding to %s: %v", s.upstreams, err)
+			if errors.Is(err, ErrNoUpstream) {
+				writeError(w, "No docker daemon available", http.StatusServiceUnavailable)
+				return
+			}
+			if errors.Is(err, ErrBodyTooLarge) {
+				writeError(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			writeError(w, "Error forwarding request to docker daemon", http.StatusBadGateway)
+		},
+		ErrorLog: l,
+	}
+
+	proxy.ServeHTTP(w, req)
+}
+
+// ServeViaUpstreamSocket forwards a request that is upgraded to a stream on its own connection
+// to the upstream, the connections are copied until one of them is closed
 func (s *SocketProxy) ServeViaUpstreamSocket(l *log.Logger, w http.ResponseWriter, req *http.Request) {
 	var sockDebug = ioutil.Discard
 	var connDebug = ioutil.Discard
@@ -82,53 +253,68 @@ func (s *SocketProxy) ServeViaUpstreamSocket(l *log.Logger, w http.ResponseWrite
 		defer connStreamer.Close()
 	}
 
-	// Dial a new socket connection for this request. Re-use might be possible, but this gets
-	// things working reliably to start with
-	sock, err := net.Dial("unix", s.path)
+	// streams get a connection of their own
+	sock, upstream, err := s.upstreams.Dial(req.Context())
 	if err != nil {
-		http.Error(w, "Error contacting backend server.", 500)
+		l.Printf("Error dialing %s: %v", s.upstreams, err)
+		writeError(w, "No docker daemon available", http.StatusServiceUnavailable)
 		return
 	}
+	if len(s.upstreams.list) > 1 {
+		l.Printf("Forwarding to %s", upstream)
+	}
 
 	defer sock.Close()
 
+	// This is really important, otherwise subsequent requests will be streamed in without
+	// being passed via the director
+	req.Header.Set("Connection", "close")
+
+	// write the request to the remote side, the body has to be read before the hijack
+	err = req.Write(io.MultiWriter(sock, sockDebug))
+	if err != nil {
+		l.Printf("Error copying request to target: %v", err)
+		if errors.Is(err, ErrBodyTooLarge) {
+			writeError(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeError(w, "Error copying request to docker daemon", http.StatusBadGateway)
+		return
+	}
+
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "Not a Hijacker?", 500)
 		return
 	}
 
+	// the server does not know about hijacked connections anymore, they are drained separately
+	// and have to be counted before the hijack so that Drain cannot miss them
+	s.streams.Add(1)
+	defer s.streams.Done()
+
 	reqConn, bufrw, err := hj.Hijack()
 	if err != nil {
 		l.Printf("Hijack error: %v", err)
 		return
 	}
+	testHookHijacked()
 
 	defer reqConn.Close()
 
-	// This is really important, otherwise subsequent requests will be streamed in without
-	// being passed via the director
-	req.Header.Set("Connection", "close")
-
-	// write the request to the remote side
-	err = req.Write(io.MultiWriter(sock, sockDebug))
-	if err != nil {
-		l.Printf("Error copying request to target: %v", err)
-		return
+	// the client might have sent more than the request before the hijack, e.g. stdin of an
+	// attach right after the upgrade, it is copied first from the buffered reader below.
+	// Only endpoints of streams are hijacked, so this is never a request of its own.
+	if n := bufrw.Reader.Buffered(); n > 0 {
+		l.Printf("Forwarding %d bytes buffered before the hijack", n)
 	}
 
-	// handle anything already buffered from before the hijack
-	if bufrw.Reader.Buffered() > 0 {
-		l.Printf("Found %d bytes buffered in reader", bufrw.Reader.Buffered())
-		rbuf, err := bufrw.Reader.Peek(bufrw.Reader.Buffered())
-		if err != nil {
-			panic(err)
-		}
-
-		// TODO: deal with this
-		l.Printf("Buffered: %s", rbuf)
-		panic("Buffered bytes not handled")
-	}
+	limits, _ := StreamLimitsFromContext(req.Context())
+	stream := newLimitedStream(l, limits, func() {
+		_ = sock.Close()
+		_ = reqConn.Close()
+	})
+	defer stream.stop("")
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -136,17 +322,22 @@ func (s *SocketProxy) ServeViaUpstreamSocket(l *log.Logger, w http.ResponseWrite
 	// Copy from request to socket
 	go func() {
 		defer wg.Done()
-		n, err := io.Copy(io.MultiWriter(sock, sockDebug), reqConn)
+		n, err := stream.copy(io.MultiWriter(sock, sockDebug), bufrw.Reader, limits.MaxBytesIn, "sent")
 		if err != nil {
 			l.Printf("Error copying request to socket: %v", err)
 		}
 		l.Printf("Copied %d bytes from downstream connection", n)
+
+		// pass on the end of the input like the docker client does for stdin
+		if cw, ok := sock.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
 	}()
 
 	// copy from socket to request
 	go func() {
 		defer wg.Done()
-		n, err := io.Copy(io.MultiWriter(reqConn, connDebug), sock)
+		n, err := stream.copy(io.MultiWriter(reqConn, connDebug), sock, limits.MaxBytesOut, "received")
 		if err != nil {
 			l.Printf("Error copying socket to request: %v", err)
 		}
@@ -0,0 +1,598 @@
+package socketproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const upgradeResponse = "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n"
+
+// fakeDaemon ... upstream on a unix socket that answers with the path and body of
+// requests, attach requests are upgraded and echo the stream
+type fakeDaemon struct {
+	server *http.Server
+	dir    string
+
+	mu    sync.Mutex
+	paths []string
+	conns int
+}
+
+func newFakeDaemon(t *testing.T) *fakeDaemon {
+	dir, err := ioutil.TempDir("", "dockerguard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "docker.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &fakeDaemon{dir: dir}
+	d.server = &http.Server{
+		Handler: http.HandlerFunc(d.serveHTTP),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				d.mu.Lock()
+				d.conns++
+				d.mu.Unlock()
+			}
+		},
+	}
+	go d.server.Serve(listener)
+	return d
+}
+
+func (d *fakeDaemon) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	d.mu.Lock()
+	d.paths = append(d.paths, req.URL.Path)
+	d.mu.Unlock()
+
+	if strings.HasSuffix(req.URL.Path, "/attach") {
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = bufrw.WriteString(upgradeResponse)
+		_ = bufrw.Flush()
+		buf := make([]byte, 1024)
+		for {
+			n, err := bufrw.Read(buf)
+			if n > 0 {
+				_, _ = conn.Write(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	// logs with follow are streamed until the client is gone, quiet ones only have a first line
+	if strings.HasSuffix(req.URL.Path, "/logs") && req.URL.Query().Get("follow") != "" {
+		for {
+			_, _ = w.Write([]byte("log line\n"))
+			w.(http.Flusher).Flush()
+			if req.URL.Query().Get("quiet") != "" {
+				<-req.Context().Done()
+				return
+			}
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	_, _ = w.Write([]byte(req.URL.Path + " " + string(body)))
+}
+
+func (d *fakeDaemon) seen(path string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, p := range d.paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *fakeDaemon) Close() {
+	_ = d.server.Close()
+	_ = os.RemoveAll(d.dir)
+}
+
+// newTestProxy ... proxy to a fake daemon that denies requests to /secret
+func newTestProxy(t *testing.T) (*fakeDaemon, *httptest.Server) {
+	return newLimitedTestProxy(t, nil)
+}
+
+// newLimitedTestProxy ... like newTestProxy, streams have the given limits
+func newLimitedTestProxy(t *testing.T, limits *StreamLimits) (*fakeDaemon, *httptest.Server) {
+	daemon := newFakeDaemon(t)
+	upstreams, err := NewUpstreams("unix://"+filepath.Join(daemon.dir, "docker.sock"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := New(upstreams, DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		if req.URL.Path == "/secret" {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				writeError(w, "Endpoint not allowed", http.StatusForbidden)
+			})
+		}
+		if limits != nil {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				upstream.ServeHTTP(w, WithStreamLimits(req, *limits))
+			})
+		}
+		return upstream
+	}))
+
+	return daemon, httptest.NewServer(proxy)
+}
+
+// sendRaw ... writes raw to a new connection to the proxy in a single write
+func sendRaw(t *testing.T, server *httptest.Server, raw string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+func readBody(t *testing.T, r *bufio.Reader) (int, string) {
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	daemon, server := newTestProxy(t)
+	defer daemon.Close()
+	defer server.Close()
+
+	conn, r := sendRaw(t, server,
+		"GET /_ping HTTP/1.1\r\nHost: docker\r\n\r\n"+
+			"GET /secret HTTP/1.1\r\nHost: docker\r\n\r\n")
+	defer conn.Close()
+
+	if code, body := readBody(t, r); code != http.StatusOK || body != "/_ping " {
+		t.Errorf("Unexpected first response %d %q", code, body)
+	}
+	// the second request passes the director as well
+	if code, _ := readBody(t, r); code != http.StatusForbidden {
+		t.Errorf("Unexpected second response %d", code)
+	}
+	if daemon.seen("/secret") {
+		t.Errorf("Pipelined request bypassed the director")
+	}
+}
+
+func TestBodyFollowedByPipelinedBytes(t *testing.T) {
+	daemon, server := newTestProxy(t)
+	defer daemon.Close()
+	defer server.Close()
+
+	conn, r := sendRaw(t, server,
+		"POST /containers/create HTTP/1.1\r\nHost: docker\r\nContent-Type: application/json\r\nContent-Length: 13\r\n\r\n"+
+			`{"Image":"a"}`+
+			"GET /secret HTTP/1.1\r\nHost: docker\r\n\r\n")
+	defer conn.Close()
+
+	if code, body := readBody(t, r); code != http.StatusOK || body != `/containers/create {"Image":"a"}` {
+		t.Errorf("Unexpected response %d %q", code, body)
+	}
+	if code, _ := readBody(t, r); code != http.StatusForbidden {
+		t.Errorf("Unexpected second response %d", code)
+	}
+	if daemon.seen("/secret") {
+		t.Errorf("Pipelined request bypassed the director")
+	}
+}
+
+func TestPipelinedAfterStream(t *testing.T) {
+	daemon, server := newTestProxy(t)
+	defer daemon.Close()
+	defer server.Close()
+
+	// requests after an attach without upgrade are part of the stream, they must
+	// not reach upstream as requests
+	conn, r := sendRaw(t, server,
+		"POST /containers/abc/attach?stream=1&stdin=1 HTTP/1.1\r\nHost: docker\r\n\r\n"+
+			"GET /secret HTTP/1.1\r\nHost: docker\r\n\r\n")
+	defer conn.Close()
+
+	if _, err := http.ReadResponse(r, nil); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("GET /secret"))
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "GET /secret" {
+		t.Errorf("Unexpected stream %q: %v", buf, err)
+	}
+	if daemon.seen("/secret") {
+		t.Errorf("Stream was served as request")
+	}
+}
+
+func TestEarlyStdinAfterUpgrade(t *testing.T) {
+	daemon, server := newTestProxy(t)
+	defer daemon.Close()
+	defer server.Close()
+
+	conn, r := sendRaw(t, server,
+		"POST /containers/abc/attach?stream=1&stdin=1&stdout=1 HTTP/1.1\r\nHost: docker\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n"+
+			"echo hello\n")
+	defer conn.Close()
+
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Unexpected status %d", resp.StatusCode)
+	}
+
+	// stdin sent together with the request is echoed like what is sent after the upgrade
+	buf := make([]byte, len("echo hello\n"))
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "echo hello\n" {
+		t.Errorf("Unexpected stream %q: %v", buf, err)
+	}
+	if _, err := conn.Write([]byte("exit\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf = make([]byte, len("exit\n"))
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "exit\n" {
+		t.Errorf("Unexpected stream %q: %v", buf, err)
+	}
+}
+
+func TestUpgradeOfOtherEndpoints(t *testing.T) {
+	daemon, server := newTestProxy(t)
+	defer daemon.Close()
+	defer server.Close()
+
+	// the request after the upgrade has to pass the director like any other
+	conn, r := sendRaw(t, server,
+		"GET /containers/abc/json HTTP/1.1\r\nHost: docker\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n"+
+			"GET /secret HTTP/1.1\r\nHost: docker\r\n\r\n")
+	defer conn.Close()
+
+	for _, expected := range []int{http.StatusOK, http.StatusForbidden} {
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != expected {
+			t.Errorf("Unexpected status %d, expected %d", resp.StatusCode, expected)
+		}
+	}
+	if daemon.seen("/secret") {
+		t.Errorf("Request after an upgrade of an endpoint that is not a stream reached the daemon")
+	}
+}
+
+func TestUpstreamKeepAlive(t *testing.T) {
+	daemon, server := newTestProxy(t)
+	defer daemon.Close()
+	defer server.Close()
+
+	var downstream int
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				downstream++
+			}
+		},
+	}
+
+	client := server.Client()
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest("GET", server.URL+"/containers/json", nil)
+		resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	daemon.mu.Lock()
+	defer daemon.mu.Unlock()
+	if daemon.conns != 1 || downstream != 1 {
+		t.Errorf("Requests used %d upstream and %d downstream connections", daemon.conns, downstream)
+	}
+}
+
+func TestDrainStreams(t *testing.T) {
+	daemon, server := newTestProxy(t)
+	defer daemon.Close()
+	defer server.Close()
+	proxy := server.Config.Handler.(*SocketProxy)
+
+	conn, r := sendRaw(t, server,
+		"POST /containers/abc/attach?stream=1&stdin=1 HTTP/1.1\r\nHost: docker\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	if _, err := http.ReadResponse(r, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := proxy.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Drain should time out while the stream is running, got %v", err)
+	}
+
+	conn.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := proxy.Drain(ctx); err != nil {
+		t.Errorf("Drain should return after the stream is done, got %v", err)
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits StreamLimits
+		// sent every 20ms until the stream is closed
+		input string
+		// minimum time until the stream is closed
+		min time.Duration
+	}{
+		{"idle timeout", StreamLimits{IdleTimeout: 100 * time.Millisecond}, "", 100 * time.Millisecond},
+		{"max duration", StreamLimits{MaxDuration: 150 * time.Millisecond}, "x", 150 * time.Millisecond},
+		// shorter than the interval the idle timeout is checked in
+		{"tiny idle timeout", StreamLimits{IdleTimeout: 5 * time.Nanosecond}, "", 0},
+		{"max bytes in", StreamLimits{MaxBytesIn: 5}, "abc", 20 * time.Millisecond},
+		// the response of the upgrade is part of the stream
+		{"max bytes out", StreamLimits{MaxBytesOut: int64(len(upgradeResponse)) + 5}, "abc", 20 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limits, input := test.limits, test.input
+			daemon, server := newLimitedTestProxy(t, &limits)
+			defer daemon.Close()
+			defer server.Close()
+
+			start := time.Now()
+			conn, r := sendRaw(t, server,
+				"POST /containers/abc/attach?stream=1&stdin=1 HTTP/1.1\r\nHost: docker\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+			defer conn.Close()
+
+			go func() {
+				for input != "" {
+					if _, err := conn.Write([]byte(input)); err != nil {
+						return
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+			}()
+
+			// the stream is closed by the proxy before the deadline of the connection
+			_, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("Stream was not closed: %v", err)
+			}
+			if d := time.Since(start); d < test.min {
+				t.Errorf("Stream was closed after %s already", d)
+			}
+		})
+	}
+}
+
+func TestStreamLimitsLogs(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits StreamLimits
+		query  string
+		// minimum time until the response is closed
+		min time.Duration
+		// maximum bytes of the response
+		max int
+	}{
+		{"idle timeout", StreamLimits{IdleTimeout: 100 * time.Millisecond}, "&quiet=1", 100 * time.Millisecond, 0},
+		{"max duration", StreamLimits{MaxDuration: 150 * time.Millisecond}, "", 150 * time.Millisecond, 0},
+		{"max bytes out", StreamLimits{MaxBytesOut: 20}, "", 20 * time.Millisecond, 20},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limits := test.limits
+			daemon, server := newLimitedTestProxy(t, &limits)
+			defer daemon.Close()
+			defer server.Close()
+
+			client := &http.Client{Timeout: 5 * time.Second}
+			start := time.Now()
+			resp, err := client.Get(server.URL + "/containers/abc/logs?follow=1" + test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			// the response is cut off by the proxy before the timeout of the client
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil && time.Since(start) >= client.Timeout {
+				t.Fatalf("Response was not closed: %v", err)
+			}
+			if d := time.Since(start); d < test.min {
+				t.Errorf("Response was closed after %s already", d)
+			}
+			if test.max > 0 && len(body) > test.max {
+				t.Errorf("Response had %d bytes, expected at most %d", len(body), test.max)
+			}
+		})
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	daemon := newFakeDaemon(t)
+	defer daemon.Close()
+	upstreams, err := NewUpstreams("unix://"+filepath.Join(daemon.dir, "docker.sock"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(New(upstreams, DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.Body = LimitBody(req.Body, 16)
+			upstream.ServeHTTP(w, req)
+		})
+	})))
+	defer server.Close()
+
+	for _, test := range []struct {
+		body     string
+		expected int
+	}{
+		{strings.Repeat("x", 16), http.StatusOK},
+		{strings.Repeat("x", 64), http.StatusRequestEntityTooLarge},
+	} {
+		// a reader of unknown size is sent chunked
+		body := ioutil.NopCloser(strings.NewReader(test.body))
+		resp, err := http.Post(server.URL+"/build", "application/x-tar", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != test.expected {
+			t.Errorf("Status for a chunked body of %d bytes was %d, expected %d", len(test.body), resp.StatusCode, test.expected)
+		}
+	}
+}
+
+func TestConcurrencyLimitStreams(t *testing.T) {
+	daemon := newFakeDaemon(t)
+	defer daemon.Close()
+	upstreams, err := NewUpstreams("unix://"+filepath.Join(daemon.dir, "docker.sock"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	immediate := NewConcurrencyLimiter(1, 0)
+	queued := NewConcurrencyLimiter(1, 5*time.Second)
+	server := httptest.NewServer(New(upstreams, DirectorFunc(func(l Logger, req *http.Request, upstream http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			limiter := immediate
+			if req.URL.Query().Get("queue") != "" {
+				limiter = queued
+			}
+			// the proxy returns once the hijacked stream is done
+			release, err := limiter.Acquire(req.Context(), "client")
+			if err != nil {
+				writeError(w, "Too many concurrent requests", http.StatusTooManyRequests)
+				return
+			}
+			defer release()
+			upstream.ServeHTTP(w, req)
+		})
+	})))
+	defer server.Close()
+
+	attach := func(query string) (net.Conn, int) {
+		conn, r := sendRaw(t, server,
+			"POST /containers/abc/attach?stream=1"+query+" HTTP/1.1\r\nHost: docker\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, resp.StatusCode
+	}
+
+	// the hijacked stream keeps its slot while it runs
+	first, code := attach("")
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("Unexpected status %d of the first stream", code)
+	}
+	second, code := attach("")
+	second.Close()
+	if code != http.StatusTooManyRequests {
+		t.Errorf("Second stream should be rejected, got %d", code)
+	}
+	first.Close()
+	for start := time.Now(); len(immediate.State()) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Slot of the first stream was not released")
+		}
+	}
+
+	// a queued stream starts once the one before is done
+	first, code = attach("&queue=1")
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("Unexpected status %d of the first queued stream", code)
+	}
+	codes := make(chan int)
+	go func() {
+		conn, code := attach("&queue=1")
+		conn.Close()
+		codes <- code
+	}()
+	time.Sleep(50 * time.Millisecond)
+	first.Close()
+	if code := <-codes; code != http.StatusSwitchingProtocols {
+		t.Errorf("Queued stream should start after the first one, got %d", code)
+	}
+}
+
+func TestDrainDuringHijack(t *testing.T) {
+	daemon, server := newTestProxy(t)
+	defer daemon.Close()
+	defer server.Close()
+	proxy := server.Config.Handler.(*SocketProxy)
+
+	// hold the stream right after the hijack, the server does not track it anymore
+	hijacked, resume := make(chan struct{}), make(chan struct{})
+	testHookHijacked = func() {
+		close(hijacked)
+		<-resume
+	}
+	defer func() { testHookHijacked = func() {} }()
+
+	conn, r := sendRaw(t, server,
+		"POST /containers/abc/attach?stream=1&stdin=1 HTTP/1.1\r\nHost: docker\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	defer conn.Close()
+	<-hijacked
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown should not wait for hijacked connections: %v", err)
+	}
+	if err := proxy.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Drain should wait for the stream being hijacked, got %v", err)
+	}
+
+	close(resume)
+	if _, err := http.ReadResponse(r, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := proxy.Drain(ctx); err != nil {
+		t.Errorf("Drain should return after the stream is done, got %v", err)
+	}
+}
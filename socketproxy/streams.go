@@ -0,0 +1,177 @@
+package socketproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamLimits are enforced on hijacked streams and on streamed responses like logs, zero
+// values mean unlimited. BytesIn is what the client sends, only on hijacked streams,
+// BytesOut what it receives.
+type StreamLimits struct {
+	IdleTimeout time.Duration
+	MaxDuration time.Duration
+	MaxBytesIn  int64
+	MaxBytesOut int64
+}
+
+type streamLimitsKey struct{}
+
+// WithStreamLimits returns a copy of req with limits for its stream
+func WithStreamLimits(req *http.Request, limits StreamLimits) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), streamLimitsKey{}, limits))
+}
+
+// StreamLimitsFromContext returns the limits set by WithStreamLimits
+func StreamLimitsFromContext(ctx context.Context) (StreamLimits, bool) {
+	limits, ok := ctx.Value(streamLimitsKey{}).(StreamLimits)
+	return limits, ok
+}
+
+// minIdleTick ... shortest interval the idle timeout of a stream is checked in
+const minIdleTick = 10 * time.Millisecond
+
+// limitedStream ... calls onStop to close the connections of a stream when one of the limits is hit
+type limitedStream struct {
+	limits StreamLimits
+	l      Logger
+	onStop func()
+
+	// unix nanos of the last data copied in either direction
+	active int64
+
+	once sync.Once
+	done chan struct{}
+}
+
+func newLimitedStream(l Logger, limits StreamLimits, onStop func()) *limitedStream {
+	ls := &limitedStream{
+		limits: limits,
+		l:      l,
+		onStop: onStop,
+		active: time.Now().UnixNano(),
+		done:   make(chan struct{}),
+	}
+
+	if limits.MaxDuration > 0 {
+		timer := time.AfterFunc(limits.MaxDuration, func() {
+			ls.stop("maximum duration of " + limits.MaxDuration.String() + " reached")
+		})
+		go func() {
+			<-ls.done
+			timer.Stop()
+		}()
+	}
+
+	if limits.IdleTimeout > 0 {
+		go ls.watchIdle()
+	}
+
+	return ls
+}
+
+// watchIdle ... stops the stream if no data was copied for the idle timeout
+func (ls *limitedStream) watchIdle() {
+	tick := ls.limits.IdleTimeout / 10
+	if tick < minIdleTick {
+		tick = minIdleTick
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ls.done:
+			return
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&ls.active))
+			if time.Since(last) > ls.limits.IdleTimeout {
+				ls.stop("idle for " + ls.limits.IdleTimeout.String())
+				return
+			}
+		}
+	}
+}
+
+// stop ... calls onStop once, reason is logged if it is set
+func (ls *limitedStream) stop(reason string) {
+	ls.once.Do(func() {
+		if reason != "" {
+			ls.l.Printf("Closing stream: %s", reason)
+		}
+		close(ls.done)
+		ls.onStop()
+	})
+}
+
+// copy ... copies from src to dst until src is done or more than max bytes would be copied
+func (ls *limitedStream) copy(dst io.Writer, src io.Reader, max int64, direction string) (int64, error) {
+	var written int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(&ls.active, time.Now().UnixNano())
+			if max > 0 && written+int64(n) > max {
+				ls.stop("more than " + strconv.FormatInt(max, 10) + " bytes " + direction)
+				return written, nil
+			}
+			wn, werr := dst.Write(buf[:n])
+			written += int64(wn)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// errStreamLimit ... error of a limitedResponse that exceeded its limit
+var errStreamLimit = errors.New("stream limit exceeded")
+
+// limitedResponse ... response body that is not hijacked, like logs with follow, closed by
+// its stream when it is idle or more than max bytes are read
+type limitedResponse struct {
+	io.ReadCloser
+	stream *limitedStream
+	max    int64
+	read   int64
+}
+
+func (lr *limitedResponse) Read(p []byte) (int, error) {
+	if lr.max > 0 && lr.read > lr.max {
+		return 0, errStreamLimit
+	}
+
+	n, err := lr.ReadCloser.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&lr.stream.active, time.Now().UnixNano())
+		left := lr.max - lr.read
+		lr.read += int64(n)
+		if lr.max > 0 && lr.read > lr.max {
+			lr.stream.stop("more than " + strconv.FormatInt(lr.max, 10) + " bytes received")
+			// only the bytes up to the limit are returned
+			if left < 0 {
+				left = 0
+			}
+			return int(left), errStreamLimit
+		}
+	}
+	return n, err
+}
+
+func (lr *limitedResponse) Close() error {
+	lr.stream.stop("")
+	return lr.ReadCloser.Close()
+}
@@ -0,0 +1,40 @@
+package socketproxy
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLimitedResponse(t *testing.T) {
+	stopped := false
+	stream := newLimitedStream(log.New(ioutil.Discard, "", 0), StreamLimits{}, func() { stopped = true })
+	lr := &limitedResponse{
+		ReadCloser: ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 30))),
+		stream:     stream,
+		max:        10,
+	}
+
+	buf := make([]byte, 8)
+	tests := []struct {
+		n   int
+		err error
+	}{
+		{8, nil},
+		// only the bytes up to the limit
+		{2, errStreamLimit},
+		// reads after the limit return nothing
+		{0, errStreamLimit},
+		{0, errStreamLimit},
+	}
+	for i, test := range tests {
+		n, err := lr.Read(buf)
+		if n != test.n || err != test.err {
+			t.Errorf("Read %d returned %d, %v, expected %d, %v", i+1, n, err, test.n, test.err)
+		}
+	}
+	if !stopped {
+		t.Errorf("Stream was not stopped at the limit")
+	}
+}
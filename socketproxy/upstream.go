@@ -0,0 +1,123 @@
+package socketproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// timeout for connecting to the upstream daemon
+	upstreamDialTimeout = 10 * time.Second
+)
+
+// Upstream is a docker daemon (or another proxy) requests are forwarded to
+type Upstream struct {
+	network string
+	address string
+	tls     *tls.Config
+}
+
+// ParseUpstream returns the upstream for an address in the syntax of DOCKER_HOST, i.e.
+// unix:///path or tcp://host:port, a plain path is a unix socket. With tlsConfig set
+// tcp connections use TLS.
+func ParseUpstream(addr string, tlsConfig *tls.Config) (*Upstream, error) {
+	u := &Upstream{}
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		u.network, u.address = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "tcp://"):
+		u.network, u.address = "tcp", strings.TrimSuffix(strings.TrimPrefix(addr, "tcp://"), "/")
+		if _, _, err := net.SplitHostPort(u.address); err != nil {
+			// default ports of the docker daemon
+			if tlsConfig != nil {
+				u.address = net.JoinHostPort(u.address, "2376")
+			} else {
+				u.address = net.JoinHostPort(u.address, "2375")
+			}
+		}
+		u.tls = tlsConfig
+	case strings.HasPrefix(addr, "/"):
+		u.network, u.address = "unix", addr
+	default:
+		return nil, fmt.Errorf("invalid upstream %s", addr)
+	}
+
+	if u.address == "" {
+		return nil, fmt.Errorf("invalid upstream %s", addr)
+	}
+	if u.tls != nil && u.tls.ServerName == "" {
+		host, _, _ := net.SplitHostPort(u.address)
+		u.tls = u.tls.Clone()
+		u.tls.ServerName = host
+	}
+
+	return u, nil
+}
+
+func (u *Upstream) String() string {
+	if u.tls != nil {
+		return "tcp+tls://" + u.address
+	}
+	return u.network + "://" + u.address
+}
+
+// Dial connects to the upstream, for TLS the handshake is done before returning
+func (u *Upstream) Dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: upstreamDialTimeout}
+	conn, err := dialer.DialContext(ctx, u.network, u.address)
+	if err != nil || u.tls == nil {
+		return conn, err
+	}
+
+	deadline := time.Now().Add(upstreamDialTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	tlsConn := tls.Client(conn, u.tls)
+	_ = tlsConn.SetDeadline(deadline)
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// ClientTLSConfig returns the TLS config for an upstream like the docker client does for
+// --tls and --tlsverify, the server certificate is verified against caFile (or the system
+// CAs if it is empty) if verify is set, a client certificate is sent if certFile is given
+func ClientTLSConfig(caFile string, certFile string, keyFile string, verify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: !verify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if verify && caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading TLS key pair: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
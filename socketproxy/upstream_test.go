@@ -0,0 +1,71 @@
+package socketproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		addr     string
+		tls      bool
+		expected string
+	}{
+		{"/var/run/docker.sock", false, "unix:///var/run/docker.sock"},
+		{"unix:///run/user/1000/docker.sock", false, "unix:///run/user/1000/docker.sock"},
+		{"tcp://10.0.0.1:2375", false, "tcp://10.0.0.1:2375"},
+		{"tcp://manager", false, "tcp://manager:2375"},
+		{"tcp://manager", true, "tcp+tls://manager:2376"},
+		{"ssh://manager", false, ""},
+		{"unix://", false, ""},
+	}
+
+	for _, test := range tests {
+		var config *tls.Config
+		if test.tls {
+			config = &tls.Config{}
+		}
+		u, err := ParseUpstream(test.addr, config)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("Upstream %s should be invalid", test.addr)
+			}
+			continue
+		}
+		if err != nil || u.String() != test.expected {
+			t.Errorf("Upstream %s was parsed to %v (%v), expected %s", test.addr, u, err, test.expected)
+		}
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	daemon := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer daemon.Close()
+
+	config := &tls.Config{RootCAs: daemon.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	u, err := ParseUpstream("tcp://"+daemon.Listener.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := u.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, _ := http.NewRequest("GET", "http://docker/_ping", nil)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected response %v: %v", resp, err)
+	}
+}
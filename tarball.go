@@ -0,0 +1,103 @@
+package dockerguard
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte{0x42, 0x5a, 0x68}
+	xzMagic    = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// tarError ... error for tarballs that cannot be read, as opposed to
+// errors returned for entries that are not allowed
+type tarError struct {
+	err error
+}
+
+func (e tarError) Error() string {
+	return "Error reading tarball: " + e.err.Error()
+}
+
+func (e tarError) Unwrap() error {
+	return e.err
+}
+
+// spoolTar ... streams a (possibly compressed) tarball from body into a temporary file
+// and calls fn for every entry while doing so. This way the body is never held in
+// memory and the returned file can be forwarded upstream once all entries are checked.
+func spoolTar(body io.Reader, fn func(hdr *tar.Header, r io.Reader) error) (*os.File, int64, error) {
+	tmp, err := spoolFile()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var fail = func(err error) (*os.File, int64, error) {
+		_ = tmp.Close()
+		return nil, 0, err
+	}
+
+	br := bufio.NewReader(io.TeeReader(body, tmp))
+	magic, _ := br.Peek(len(xzMagic))
+
+	var r io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return fail(tarError{err})
+		}
+		r = gr
+	case bytes.HasPrefix(magic, bzip2Magic):
+		r = bzip2.NewReader(br)
+	case bytes.HasPrefix(magic, xzMagic), bytes.HasPrefix(magic, zstdMagic):
+		return fail(tarError{fmt.Errorf("unsupported compression")})
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(tarError{err})
+		}
+		if err := fn(hdr, tr); err != nil {
+			return fail(err)
+		}
+	}
+
+	// spool whatever follows the end of the archive, e.g. padding
+	if _, err := io.Copy(ioutil.Discard, br); err != nil {
+		return fail(tarError{err})
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+
+	return tmp, size, nil
+}
+
+// setSpooledBody ... replaces the body of req by a spooled file of the given size
+func setSpooledBody(req *http.Request, body *os.File, size int64) {
+	req.Body = body
+	req.ContentLength = size
+	req.TransferEncoding = nil
+}